@@ -2,12 +2,27 @@
 
 Alert check implementation (scheduled cron job).
 
-Checks if everything is ok with the Car and its
-GPS device and sends alert emails if something is (or might be) wrong.
+Evaluates the alert rules configured by the accounts, and sends alert emails if something is (or might be) wrong.
+Each rule type (see ds.RuleTypes) has its own checker, which tells if the alert is firing.
 
-Also checks if the Car is reported moving when personal mobile is not or they are far away from each other
+The state of the alerts is persisted (see ds.Alert.State): notifications are sent when an alert starts firing,
+when it is resolved, and while it is firing, reminders are sent at the reminder interval of the alert (if any).
+Alerts are only checked inside their schedule (see ds.Alert.Schedule), and only critical alerts are notified
+in the quiet hours of the account.
+
+Evaluations finding an alert firing (and resolving it) are recorded in the alert history (see ds.AlertHist),
+along with their notification attempts (see ds.Notification). The history is kept for ds.AlertHistRetentionDays.
+
+The hijack rule checks if everything is ok with the Car and its GPS device,
+and also checks if the Car is reported moving when personal mobile is not or they are far away from each other
 when car is moving.
 
+The speed rule fires during speeding episodes, the start of the current episode is stored in the Alert.
+
+The geofence rule tracks whether the device is inside or outside of the geofence (see ds.GeofenceState),
+logs the boundary crossings as Enter and Exit events (see ds.GeofenceEvent), and alerts on the crossings it is configured for.
+Crossings stay pending until they are notified successfully (see ds.Alert.EventsNotified).
+
 */
 
 package igps
@@ -15,12 +30,16 @@ package igps
 import (
 	"appengine"
 	"appengine/datastore"
-	"appengine/mail"
+	"bytes"
 	"fmt"
+	"igps/cache"
 	"igps/ds"
+	"igps/maps"
+	"igps/notify"
 	"igps/page/logic"
 	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -28,8 +47,67 @@ func init() {
 	http.HandleFunc("/cron/alert", alertHandler)
 }
 
+// alertRun holds the data shared by the alert checks of a cron job run.
+type alertRun struct {
+	// Geofence boundary crossings detected in this run, mapped from the key names of the geofence states.
+	// Several alerts may watch the same device and geofence, crossings are only detected (and logged) once.
+	gfCrossings map[string][]*ds.GeofenceEvent
+
+	// Loaded accounts, mapped from their key IDs.
+	accounts map[int64]*ds.Account
+}
+
+// account returns the account with the specified key ID, loaded once per run.
+func (run *alertRun) account(c appengine.Context, accKeyID int64) (*ds.Account, error) {
+	if acc := run.accounts[accKeyID]; acc != nil {
+		return acc, nil
+	}
+	acc := new(ds.Account)
+	if err := datastore.Get(c, datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil), acc); err != nil {
+		c.Errorf("Failed to load account: %v", err)
+		return nil, err
+	}
+	acc.KeyID = accKeyID
+	run.accounts[accKeyID] = acc
+	return acc, nil
+}
+
+// alertFiring tells that an alert is firing, and describes its notification.
+type alertFiring struct {
+	// Message of the alert, the subject of the notification
+	Msg string
+
+	// Template of the body of the notification and its arguments (see sendAlert())
+	BodyTempl string
+	Args      []interface{}
+
+	// Latest GPS records of the device (in reverse chronological order), a map of them is attached
+	Records []*ds.GPS
+
+	// Positions that triggered the alert (in reverse chronological order), recorded in the alert history.
+	// If nil, the positions of the Records are recorded.
+	Positions []ds.Position
+
+	// Events (of event rule types) up to this time are notified by the notification:
+	// it is stored as the EventsNotified of the alert once the notification is sent successfully.
+	EventsUntil time.Time
+}
+
+// ruleChecker checks an alert of a rule type. accKeyID is the key ID of the owner account.
+// Returns a non-nil firing if the alert is firing. Returns an error if the check could not be completed,
+// in which case the state of the alert is left unchanged.
+type ruleChecker func(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64) (firing *alertFiring, err error)
+
+// ruleCheckers maps from rule type names to their checkers.
+var ruleCheckers = map[string]ruleChecker{
+	ds.RuleHijack:   checkHijack,
+	ds.RuleDark:     checkDark,
+	ds.RuleGeofence: checkGeofence,
+	ds.RuleSpeed:    checkSpeed,
+}
+
 // alertHandler is the handler of the alert check cron job.
-// Processes all Alerts.
+// Processes all Alerts, each checked by the checker of its rule type.
 func alertHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
@@ -55,63 +133,334 @@ func alertHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	c.Infof("Loaded %d alert%s.", len(alerts), plural)
 
+	run := &alertRun{gfCrossings: make(map[string][]*ds.GeofenceEvent), accounts: make(map[int64]*ds.Account)}
+
 	for i, alert := range alerts {
 		alert.KeyID = alertKeys[i].IntID()
 		accKeyID := alertKeys[i].Parent().IntID()
 		c.Infof("Processing #%d ...", i)
 		c.Debugf("Alert id: %d, owner account id: %d", alert.KeyID, accKeyID)
-		c.Debugf("Car dev id: %d, pers mob dev id: %d", alert.CarDevID, alert.PersMobDevID)
+		if err := alert.ParamsError(); err != nil {
+			c.Errorf("Invalid alert parameters, alert skipped: %v", err)
+			continue
+		}
+		c.Debugf("Type: %s, dev id: %d, params: %v", alert.GetType(), alert.DevID, alert.ParamValues())
+
+		checker := ruleCheckers[alert.GetType()]
+		if checker == nil {
+			c.Errorf("Unknown alert rule type: %s", alert.GetType())
+			continue
+		}
+		acc, err := run.account(c, accKeyID)
+		if err != nil {
+			continue
+		}
+		before := alert.Encode()
+		if alert.Secret == "" {
+			// Alerts created before acknowledge links
+			if alert.Secret, err = logic.NewAlertSecret(); err != nil {
+				c.Warningf("Failed to generate alert secret: %v", err)
+			}
+		}
+		now := time.Now()
+		if alert.Active(now.In(acc.Location())) {
+			firing, err := checker(c, run, alert, accKeyID)
+			if err != nil {
+				continue
+			}
+			quiet := acc.InQuietHours(now) && !alert.Critical
+			updateState(c, run, alert, accKeyID, firing, now, quiet)
+		} else {
+			c.Infof("Alert is outside of its schedule, skipped.")
+			alert.Reset(now)
+		}
+		if !bytes.Equal(before, alert.Encode()) {
+			if err := saveAlert(c, alert, accKeyID); err != nil {
+				c.Errorf("Failed to save alert: %v", err)
+			}
+		}
+	}
+
+	pruneAlertHist(c, time.Now())
+}
+
+// Max number of entities of each kind deleted by pruneAlertHist() in a run.
+const maxHistPrune = 500
 
-		checkAlert(c, alert, accKeyID)
+// pruneAlertHist deletes the alert history entries, notification attempts and geofence crossings older than the retention
+// (ds.AlertHistRetentionDays). Alert checks run often, so a limited number is deleted in a run.
+func pruneAlertHist(c appengine.Context, now time.Time) {
+	limit := now.AddDate(0, 0, -ds.AlertHistRetentionDays)
+	for _, ename := range []string{ds.ENameAlertHist, ds.ENameNotification, ds.ENameGeofenceEvent} {
+		// Note: this is not an ancestor query but it is not a problem (deleted by the next run if missed).
+		q := datastore.NewQuery(ename).Filter(ds.PNameCreated+"<", limit).KeysOnly().Limit(maxHistPrune)
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			c.Errorf("Failed to list expired %s entities: %v", ename, err)
+			continue
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		if err = datastore.DeleteMulti(c, keys); err != nil {
+			c.Errorf("Failed to delete expired %s entities: %v", ename, err)
+			continue
+		}
+		c.Infof("Deleted %d expired %s entities.", len(keys), ename)
 	}
 }
 
-// checkAlert checks the specified alert.
-func checkAlert(c appengine.Context, a *ds.Alert, accKeyID int64) {
-	const alertDurationMin = 5
-	const alertDuration = alertDurationMin * time.Minute
+// updateState updates the state of the specified alert based on the result of its check (firing is nil if
+// the alert is not firing), and sends the notifications: when the alert starts firing, reminders while it is firing
+// (if the alert has a reminder interval) and when it is resolved.
+// Alerts of event rule types are notified of every event, and they have no reminders and resolved notifications.
+// Snoozed alerts and non-critical alerts in the quiet hours of the account (quiet is true) are not notified,
+// and acknowledged alerts have no reminders and resolved notifications.
+//
+// The state only changes if the notification is sent successfully, so failed notifications are retried by the next run.
+// Firing and resolving evaluations are recorded in the alert history, evaluations finding the alert still firing
+// without notifying it continue the last entry (see continueAlertHist()).
+func updateState(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64, firing *alertFiring, now time.Time, quiet bool) {
+	event := a.RuleType().Event
+	state := a.GetState()
+	snoozed, acked := a.Snoozed(now) || quiet, a.Acknowledged()
+
+	// Reason of suppressed notifications
+	reason := "acknowledged"
+	if a.Snoozed(now) {
+		reason = "snoozed"
+	} else if quiet {
+		reason = "quiet hours"
+	}
+
+	h := &ds.AlertHist{AlertID: a.KeyID, Type: a.GetType(), DevID: a.DevID, Created: now}
+	if firing != nil {
+		h.Msg = firing.Msg
+		if h.Positions = firing.Positions; h.Positions == nil {
+			h.Positions = histPositions(firing.Records)
+		}
+	}
+	var ntfs []*ds.Notification
+
+	switch {
+	case firing != nil && (state != ds.StateFiring || event):
+		h.Kind = notify.KindAlert
+		if snoozed {
+			// State is not changed so it is notified when the snooze or the quiet hours end (if still firing)
+			c.Infof("Alert firing, but snoozed (until %v) or in quiet hours: %s", a.SnoozedUntil, firing.Msg)
+			h.Outcome, h.Reason = ds.OutcomeSuppressed, reason
+			break
+		}
+		c.Warningf("Alert firing: %s", firing.Msg)
+		ntfs = sendAlert(c, run, a, accKeyID, h, firing.Msg, firing.BodyTempl, ackLinks(a, accKeyID, now, !event), firing.Records, firing.Args...)
+		if h.Outcome = outcome(ntfs); h.Outcome == ds.OutcomeNotified {
+			if state != ds.StateFiring {
+				a.State, a.StateSince = ds.StateFiring, now
+			}
+			a.LastMsg, a.LastNotified = firing.Msg, now
+			if !firing.EventsUntil.IsZero() {
+				a.EventsNotified = firing.EventsUntil
+			}
+		}
+	case firing != nil:
+		switch {
+		case snoozed || acked:
+			c.Infof("Alert still firing since %v, snoozed, in quiet hours or acknowledged.", a.StateSince)
+			h.Outcome, h.Reason = ds.OutcomeSuppressed, reason
+		case a.Reminder > 0 && now.Sub(a.LastNotified) >= time.Duration(a.Reminder)*time.Minute:
+			c.Warningf("Alert still firing, sending reminder: %s", firing.Msg)
+			h.Kind = notify.KindReminder
+			ntfs = sendAlert(c, run, a, accKeyID, h, firing.Msg, firing.BodyTempl, ackLinks(a, accKeyID, now, true), firing.Records, firing.Args...)
+			if h.Outcome = outcome(ntfs); h.Outcome == ds.OutcomeNotified {
+				a.LastMsg, a.LastNotified = firing.Msg, now
+			}
+		default:
+			c.Infof("Alert still firing since %v, already notified.", a.StateSince)
+			h.Outcome = ds.OutcomeOngoing
+		}
+	case state == ds.StateFiring && event:
+		a.State, a.StateSince = ds.StateOK, now
+	case state == ds.StateFiring && (snoozed || acked):
+		c.Infof("Alert resolved (snoozed, in quiet hours or acknowledged, not notified): %s", a.LastMsg)
+		a.State, a.StateSince = ds.StateResolved, now
+		h.Kind, h.Msg, h.Outcome, h.Reason = notify.KindResolved, a.LastMsg, ds.OutcomeSuppressed, reason
+	case state == ds.StateFiring:
+		c.Infof("Alert resolved: %s", a.LastMsg)
+		records, _ := getDevRecords(c, a.DevID)
+		h.Kind, h.Msg, h.Positions = notify.KindResolved, a.LastMsg, histPositions(records)
+		ntfs = sendAlert(c, run, a, accKeyID, h, a.LastMsg, resolvedAlertMail, "", records,
+			a.LastMsg, a.StateSince.UTC().Format(timeLayoutMail), now.UTC().Format(timeLayoutMail))
+		if h.Outcome = outcome(ntfs); h.Outcome == ds.OutcomeNotified {
+			a.State, a.StateSince, a.LastNotified = ds.StateResolved, now, now
+		}
+	default:
+		c.Infof("Alert not firing. Ok.")
+	}
+
+	if h.Outcome == "" {
+		return
+	}
+	if len(ntfs) == 0 && h.Kind != notify.KindResolved && continueAlertHist(c, a, accKeyID, h) {
+		return
+	}
+	if err := saveAlertHist(c, accKeyID, h, ntfs); err != nil {
+		c.Errorf("Failed to save alert history: %v", err)
+		return
+	}
+	a.HistID = h.KeyID
+}
+
+// continueAlertHist continues the last alert history entry of the specified alert (see ds.Alert.HistID) with
+// the specified evaluation which found the alert still firing without notifying it, so a firing alert does not
+// add an entry on every run. The entry is continued if the alert is still firing since it was saved,
+// and the evaluation is ongoing or has the same outcome. Returns true if the entry was continued.
+func continueAlertHist(c appengine.Context, a *ds.Alert, accKeyID int64, h *ds.AlertHist) bool {
+	if a.HistID == 0 {
+		return false
+	}
+	accKey := datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil)
+	key := datastore.NewKey(c, ds.ENameAlertHist, "", a.HistID, accKey)
+	var last ds.AlertHist
+	if err := datastore.Get(c, key, &last); err != nil {
+		if err != datastore.ErrNoSuchEntity { // Else deleted by pruneAlertHist()
+			c.Errorf("Failed to load alert history entry: %v", err)
+		}
+		return false
+	}
+	if last.Kind == notify.KindResolved || h.Outcome != ds.OutcomeOngoing && (h.Outcome != last.Outcome || h.Reason != last.Reason) {
+		return false
+	}
+	last.Until = h.Created
+	last.Repeats++
+	if _, err := datastore.Put(c, key, &last); err != nil {
+		c.Errorf("Failed to save alert history entry: %v", err)
+		return false
+	}
+	return true
+}
+
+// outcome returns the outcome of an alert evaluation based on its notification attempts:
+// ds.OutcomeNotified if any of them succeeded (or is queued for delivery), else ds.OutcomeFailed.
+func outcome(ntfs []*ds.Notification) string {
+	for _, n := range ntfs {
+		if n.Success || n.Pending {
+			return ds.OutcomeNotified
+		}
+	}
+	return ds.OutcomeFailed
+}
+
+// histPositions returns the positions of the Track records of the specified GPS records, to be recorded in the alert history.
+func histPositions(records []*ds.GPS) []ds.Position {
+	var positions []ds.Position
+	for _, r := range records {
+		if r.Track() {
+			positions = append(positions, ds.Position{GeoPoint: r.GeoPoint, Time: r.Created})
+		}
+	}
+	return positions
+}
+
+// saveAlertHist saves the specified alert history entry of the account with the specified id,
+// and the specified notification attempts of the evaluation (except the pending ones which are saved
+// when queued, see notifyChannel()). The key ID of the entry is used if already allocated by sendAlert().
+func saveAlertHist(c appengine.Context, accKeyID int64, h *ds.AlertHist, ntfs []*ds.Notification) error {
+	accKey := datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil)
+	key := datastore.NewIncompleteKey(c, ds.ENameAlertHist, accKey)
+	if h.KeyID != 0 {
+		key = datastore.NewKey(c, ds.ENameAlertHist, "", h.KeyID, accKey)
+	}
+	key, err := datastore.Put(c, key, h)
+	if err != nil {
+		return err
+	}
+	h.KeyID = key.IntID()
+
+	var keys []*datastore.Key
+	var unsaved []*ds.Notification
+	for _, n := range ntfs {
+		if n.KeyID != 0 {
+			continue
+		}
+		n.HistID, n.Created = key.IntID(), h.Created
+		keys = append(keys, datastore.NewIncompleteKey(c, ds.ENameNotification, accKey))
+		unsaved = append(unsaved, n)
+	}
+	if len(unsaved) == 0 {
+		return nil
+	}
+	_, err = datastore.PutMulti(c, keys, unsaved)
+	return err
+}
+
+// ackLinks returns the signed acknowledge links of the specified alert to be included in its notifications
+// (empty if the alert has no secret). The "It's me" link is only included if me is true.
+func ackLinks(a *ds.Alert, accKeyID int64, now time.Time, me bool) string {
+	if a.Secret == "" {
+		return ""
+	}
+	exp := now.Add(logic.AckLinkValidity)
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "False alarm? You can silence this alert without logging in (links are valid for %d hours):\n", logic.AckLinkValidity/time.Hour)
+	if me {
+		fmt.Fprintf(buf, "It's me (no more reminders until resolved): %s\n", logic.AlertAckURL(a, accKeyID, logic.AckActionMe, exp))
+	}
+	fmt.Fprintf(buf, "Snooze 2 hours: %s\n", logic.AlertAckURL(a, accKeyID, logic.AckActionSnooze, exp))
+	fmt.Fprintf(buf, "Disable until tomorrow: %s\n\n", logic.AlertAckURL(a, accKeyID, logic.AckActionTomorrow, exp))
+	return buf.String()
+}
+
+// Layout of times in alert emails.
+const timeLayoutMail = "2006-01-02 15:04:05 MST"
+
+// checkHijack checks the specified alert of RuleHijack type.
+func checkHijack(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64) (*alertFiring, error) {
+	values := a.ParamValues()
+	persMobDevID := values["persMob"]
+	alertDurationMin := values["darkMinutes"]
+	alertDuration := time.Duration(alertDurationMin) * time.Minute
+	minMove := values["minMove"] // [m]
 
 	// Get latest car GPS records
-	carRecords, err := getDevRecords(c, a.CarDevID)
+	carRecords, err := getDevRecords(c, a.DevID)
 	if err != nil {
-		return
+		return nil, err
 	}
+	movingWithoutYou := &alertFiring{Msg: "Car is moving without you!", BodyTempl: carMovingWithoutYouMail, Records: carRecords}
 
 	// Check if car GPS records are received properly:
 	if time.Since(carRecords[0].Created) > alertDuration {
 		c.Warningf("No car GPS records found in the last %d minutes!", alertDurationMin)
-		sendAlert(c, accKeyID, "Car GPS device gone dark!", carGoneDarkAlertMail)
-		return
+		return &alertFiring{Msg: "Car GPS device gone dark!", BodyTempl: carGoneDarkAlertMail, Args: []interface{}{alertDurationMin}, Records: carRecords}, nil
 	}
 
-	if a.PersMobDevID == 0 {
-		c.Debugf("Car GPS records found in the last 5 minutes. No Personal Mobile device specified.")
-		return
+	if persMobDevID == 0 {
+		c.Debugf("Car GPS records found in the last %d minutes. No Personal Mobile device specified.", alertDurationMin)
+		return nil, nil
 	}
 
-	carMoved := devMoved(carRecords)
+	carMoved := devMoved(carRecords, minMove)
 	if !carMoved {
 		// Nothing more to do if car is not moving
 		c.Infof("Car is not moving. Ok.")
-		return
+		return nil, nil
 	}
 
 	c.Infof("Car is moving!")
 
 	// Get latest personal mobile GPS records
-	persMobRecords, err := getDevRecords(c, a.PersMobDevID)
+	persMobRecords, err := getDevRecords(c, persMobDevID)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	// Check if personal mobile GPS records are received properly:
 	if time.Since(persMobRecords[0].Created) > alertDuration {
 		c.Warningf("No personal mobile GPS records found in the last %d minutes!", alertDurationMin)
-		sendAlert(c, accKeyID, "Car is moving without you!", carMovingWithoutYouMail)
-		return
+		return movingWithoutYou, nil
 	}
 
-	persMobMoved := devMoved(persMobRecords)
+	persMobMoved := devMoved(persMobRecords, minMove)
 
 	// Do not draw fast conclusion here if personal mobile is not moving,
 	// it might be GPS tracking was just turned on and we don't have 2 track records yet
@@ -135,8 +484,7 @@ func checkAlert(c appengine.Context, a *ds.Alert, accKeyID int64) {
 	if pg1 == nil || time.Since(pg1.Created) > alertDuration {
 		// Car is moving and we don't have recent track record from personal mobile!
 		c.Warningf("No personal mobile GPS track record found in the last %d minutes!", alertDurationMin)
-		sendAlert(c, accKeyID, "Car is moving without you!", carMovingWithoutYouMail)
-		return
+		return movingWithoutYou, nil
 	}
 
 	// Check distance:
@@ -163,26 +511,447 @@ func checkAlert(c appengine.Context, a *ds.Alert, accKeyID int64) {
 	c.Debugf("Delta T between latest Car and PersMob GPS records: %d s", int64(cpdt))
 	c.Debugf("Car - PersMob distance: %d m", dist)
 
-	var alertMargin int64 = 500 // [m]
+	alertMargin := values["margin"]         // [m]
+	accuracy := float64(values["accuracy"]) // [m/s]
 	// Increase alert margin based on the movement speed of the car and the delta time between
 	// the last car and personal mobile GPS records.
 	// Also if this delta time is greater, accuracy decreases/drops.
-	// So also increase alert margin based on delta time: 6 meters for every second.
+	// So also increase alert margin based on delta time: by default 6 meters for every second.
 	// (It is an effect like increasing car speed by 6 m/s = 21.6 km/h.)
 	// BE RESTRICTIVE: Only do this correction if personal mobile is also moving!
 	// If not, do not let the car get far away (if for example pers mob is not moving,
 	// the car could get kilometers away before alert would be sent).
 	if persMobMoved {
-		alertMargin += int64(cv*cpdt + cpdt*6)
+		alertMargin += int64(cv*cpdt + cpdt*accuracy)
 	}
 	c.Debugf("Using alert margin distance: %d m", alertMargin)
 
 	if dist > alertMargin {
 		c.Warningf("Personal mobile is not moving together with car!")
-		sendAlert(c, accKeyID, "Car is moving without you!", carMovingWithoutYouMail)
-		return
+		return movingWithoutYou, nil
 	}
 	c.Infof("They are moving together. Ok.")
+	return nil, nil
+}
+
+// checkDark checks the specified alert of RuleDark type.
+func checkDark(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64) (*alertFiring, error) {
+	minutes := a.Param("minutes")
+
+	records, err := getDevRecords(c, a.DevID)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(records[0].Created) > time.Duration(minutes)*time.Minute {
+		c.Warningf("No GPS records found in the last %d minutes!", minutes)
+		name := devName(c, accKeyID, a.DevID)
+		return &alertFiring{Msg: name + " gone dark!", BodyTempl: devGoneDarkAlertMail, Args: []interface{}{name, minutes}, Records: records}, nil
+	}
+	c.Infof("GPS records found in the last %d minutes. Ok.", minutes)
+	return nil, nil
+}
+
+// Geofence check parameters.
+const (
+	// Max number of GPS records of a device processed in a batch by a geofence check
+	maxGeofenceRecords = 100
+
+	// Time budget of processing the new GPS records of a device by a geofence check.
+	// If there are more new records, the rest is processed by the next runs.
+	geofenceCheckBudget = 20 * time.Second
+
+	// Max number of pending (not yet notified) geofence crossings processed by a geofence check
+	maxGeofencePending = 100
+)
+
+// checkGeofence checks the specified alert of RuleGeofence type.
+//
+// Crossings are pending until they are notified: the alert fires on the crossings following the last notified one
+// (see ds.Alert.EventsNotified), so crossings not notified (e.g. failed notifications, snoozed alert) are notified later.
+func checkGeofence(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64) (*alertFiring, error) {
+	gfID, trigger := a.Param("geofence"), a.Param("trigger")
+	accKey := datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil)
+
+	geofences, err := cache.GetGeofenceListForAccKey(c, accKey)
+	if err != nil {
+		c.Errorf("Failed to load geofences: %v", err)
+		return nil, err
+	}
+	var gf *ds.Geofence
+	for _, g := range geofences {
+		if g.KeyID == gfID {
+			gf = g
+		}
+	}
+	if gf == nil {
+		c.Errorf("Geofence not found! id: %d", gfID)
+		return nil, fmt.Errorf("Geofence not found! id: %d", gfID)
+	}
+
+	stateName := fmt.Sprintf("%d-%d", a.DevID, gfID)
+	crossings, ok := run.gfCrossings[stateName]
+	if !ok {
+		if crossings, err = geofenceCrossings(c, accKey, datastore.NewKey(c, ds.ENameGeofenceState, stateName, 0, accKey), gf, a.DevID); err != nil {
+			return nil, err
+		}
+		run.gfCrossings[stateName] = crossings
+	}
+
+	// Pending crossings: the logged ones following the last notified one (the ancestor query is strongly consistent,
+	// it sees the ones detected in this run). Alerts which have not notified any crossings yet
+	// (created before pending crossings) only have the ones detected in this run.
+	pending := crossings
+	if !a.EventsNotified.IsZero() {
+		pending = nil
+		q := datastore.NewQuery(ds.ENameGeofenceEvent).Ancestor(accKey).Filter(ds.PNameDevKeyID+"=", a.DevID).Filter(ds.PNameGeofenceID+"=", gfID)
+		q = q.Filter(ds.PNameCreated+">", a.EventsNotified).Order(ds.PNameCreated).Limit(maxGeofencePending)
+		if _, err = q.GetAll(c, &pending); err != nil {
+			c.Errorf("Failed to get pending geofence crossings: %v", err)
+			return nil, err
+		}
+	}
+	if len(pending) > maxGeofencePending {
+		pending = pending[:maxGeofencePending]
+	}
+	if len(pending) == 0 {
+		c.Infof("No geofence crossings to alert on. Ok.")
+		return nil, nil
+	}
+
+	acc, err := run.account(c, accKeyID)
+	if err != nil {
+		return nil, err
+	}
+	last := pending[len(pending)-1].Created
+	var alerted []*ds.GeofenceEvent
+	for _, r := range pending {
+		if !a.Active(r.Created.In(acc.Location())) {
+			continue // Not alerted, crossings outside of the schedule are only detected when the schedule starts
+		}
+		if r.Evt == ds.EvtEnter && trigger&ds.TriggerEnter != 0 || r.Evt == ds.EvtExit && trigger&ds.TriggerExit != 0 {
+			alerted = append(alerted, r)
+		}
+	}
+	if len(alerted) == 0 {
+		// Nothing to notify, the pending crossings are done
+		c.Infof("No geofence crossings to alert on. Ok.")
+		a.EventsNotified = last
+		return nil, nil
+	}
+
+	// Alert on the last crossing
+	lastAlerted := alerted[len(alerted)-1]
+	what := "entered"
+	if lastAlerted.Evt == ds.EvtExit {
+		what = "exited"
+	}
+	c.Warningf("Device %s geofence %s!", what, gf.Name)
+
+	records, err := getDevRecords(c, a.DevID)
+	if err != nil {
+		return nil, err
+	}
+	name := devName(c, accKeyID, a.DevID)
+	positions := make([]ds.Position, len(alerted))
+	for i, r := range alerted {
+		positions[len(alerted)-1-i] = ds.Position{GeoPoint: r.GeoPoint, Time: r.Created}
+	}
+	return &alertFiring{Msg: fmt.Sprintf("%s %s %s!", name, what, gf.Name), BodyTempl: geofenceAlertMail, Records: records, Positions: positions, EventsUntil: last,
+		Args: []interface{}{name, what, gf.Name, lastAlerted.Created.UTC().Format(timeLayoutMail), lastAlerted.GeoPoint.Lat, lastAlerted.GeoPoint.Lng, len(alerted)}}, nil
+}
+
+// geofenceCrossings processes the new GPS records of the specified device, and returns the crossings of the boundary
+// of the specified geofence as Enter and Exit events. The events are saved under the specified account key,
+// and the state of the device (stored with the specified key) is updated.
+// Records are processed in batches until all new records are processed or the time budget runs out.
+//
+// If the state does not exist yet, it is initialized from the latest Track record (no crossing is reported).
+func geofenceCrossings(c appengine.Context, accKey, stateKey *datastore.Key, gf *ds.Geofence, devID int64) (crossings []*ds.GeofenceEvent, err error) {
+	var state ds.GeofenceState
+	if err = datastore.Get(c, stateKey, &state); err == datastore.ErrNoSuchEntity {
+		records, err := getDevRecords(c, devID)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.Track() {
+				state = ds.GeofenceState{Inside: logic.GeofenceContains(gf, r.GeoPoint), Time: records[0].Created}
+				if _, err = datastore.Put(c, stateKey, &state); err != nil {
+					c.Errorf("Failed to save geofence state: %v", err)
+					return nil, err
+				}
+				c.Infof("Geofence state initialized, inside: %v", state.Inside)
+				return nil, nil
+			}
+		}
+		c.Infof("No Track records to initialize geofence state from.")
+		return nil, nil
+	} else if err != nil {
+		c.Errorf("Failed to load geofence state: %v", err)
+		return nil, err
+	}
+
+	start, processed := time.Now(), 0
+	for {
+		q := datastore.NewQuery(ds.ENameGPS).Filter(ds.PNameDevKeyID+"=", devID).Filter(ds.PNameCreated+">", state.Time)
+		q = q.Order(ds.PNameCreated).Limit(maxGeofenceRecords)
+		var records []*ds.GPS
+		if _, err = q.GetAll(c, &records); err != nil {
+			c.Errorf("Failed to get new GPS records for device id: %d: %v", devID, err)
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		var batch []*ds.GeofenceEvent // Crossings of the batch
+		for _, r := range records {
+			if !r.Track() {
+				continue
+			}
+			inside := logic.GeofenceContains(gf, r.GeoPoint)
+			if inside == state.Inside {
+				continue
+			}
+			state.Inside = inside
+			evt := ds.EvtExit
+			if inside {
+				evt = ds.EvtEnter
+			}
+			batch = append(batch, &ds.GeofenceEvent{DevKeyID: devID, GeofenceID: gf.KeyID, Evt: evt, GeoPoint: r.GeoPoint, Created: r.Created})
+		}
+		state.Time = records[len(records)-1].Created
+
+		// Batches are saved one by one, so the progress is kept if a later batch fails
+		if len(batch) > 0 {
+			keys := make([]*datastore.Key, len(batch))
+			for i := range keys {
+				keys[i] = datastore.NewIncompleteKey(c, ds.ENameGeofenceEvent, accKey)
+			}
+			if _, err = datastore.PutMulti(c, keys, batch); err != nil {
+				c.Errorf("Failed to save geofence events: %v", err)
+				return nil, err
+			}
+		}
+		if _, err = datastore.Put(c, stateKey, &state); err != nil {
+			c.Errorf("Failed to save geofence state: %v", err)
+			return nil, err
+		}
+		crossings = append(crossings, batch...)
+		processed += len(records)
+
+		if len(records) < maxGeofenceRecords {
+			break // Caught up
+		}
+		if time.Since(start) > geofenceCheckBudget {
+			c.Warningf("Geofence check time budget exceeded, the rest of the new records is processed by the next run.")
+			break
+		}
+	}
+
+	c.Infof("Processed %d GPS records, %d geofence crossings.", processed, len(crossings))
+	return crossings, nil
+}
+
+// Speed check parameters.
+const (
+	// Time range to process if no records have been processed yet, and time range of records preceding the
+	// processed ones queried to calculate speeds
+	speedCheckLookback = 10 * time.Minute
+
+	// Max number of new GPS records of a device processed by a speed check (and max number of preceding records queried)
+	maxSpeedRecords = 500
+
+	// A speeding episode ends if the device does not report for this long (e.g. it was switched off or lost signal)
+	speedDarkTimeout = 15 * time.Minute
+)
+
+// speedEpisode is a period of time during which a device exceeded the speed limit.
+type speedEpisode struct {
+	Start time.Time
+
+	// Track record of the peak speed, and the peak speed in km/h
+	Peak  *ds.GPS
+	PeakV float64
+}
+
+// checkSpeed checks the specified alert of RuleSpeed type. The alert is firing during speeding episodes.
+// An episode ends when the speed drops below the limit, at a Stop event, or if the device does not report
+// for speedDarkTimeout.
+//
+// The GPS records following the last processed one are checked, preceded by the records of a possible
+// speeding episode not yet detected (which started at most the sustained duration earlier).
+// The preceding records are queried separately, so the checks keep up even if there are many of them.
+func checkSpeed(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64) (*alertFiring, error) {
+	limit, seconds := a.Param("limit"), a.Param("seconds")
+	sustain := time.Duration(seconds) * time.Second
+
+	checked := a.SpeedChecked
+	if checked.IsZero() {
+		checked = time.Now().Add(-speedCheckLookback)
+	}
+	// New records
+	q := datastore.NewQuery(ds.ENameGPS).Filter(ds.PNameDevKeyID+"=", a.DevID).Filter(ds.PNameCreated+">", checked)
+	q = q.Order(ds.PNameCreated).Limit(maxSpeedRecords)
+	var records []*ds.GPS
+	if _, err := q.GetAll(c, &records); err != nil {
+		c.Errorf("Failed to get GPS records for device id: %d: %v", a.DevID, err)
+		return nil, err
+	}
+	if len(records) == 0 {
+		// Nothing new, the episode (if any) is not over unless the device went dark
+		c.Infof("No new GPS records.")
+		if !a.SpeedEpisode.IsZero() && time.Since(a.SpeedChecked) > speedDarkTimeout {
+			c.Infof("No GPS records for %v, speeding episode ended.", speedDarkTimeout)
+			a.SpeedEpisode = time.Time{}
+		}
+	} else {
+		// Preceding records (latest first), queried separately so they can't crowd out the new ones
+		q = datastore.NewQuery(ds.ENameGPS).Filter(ds.PNameDevKeyID+"=", a.DevID).Filter(ds.PNameCreated+">", checked.Add(-sustain-speedCheckLookback))
+		q = q.Filter(ds.PNameCreated+"<=", checked).Order("-" + ds.PNameCreated).Limit(maxSpeedRecords)
+		var preceding []*ds.GPS
+		if _, err := q.GetAll(c, &preceding); err != nil {
+			c.Errorf("Failed to get GPS records for device id: %d: %v", a.DevID, err)
+			return nil, err
+		}
+		chrono := make([]*ds.GPS, len(preceding), len(preceding)+len(records))
+		for i, r := range preceding {
+			chrono[len(preceding)-1-i] = r
+		}
+		records = append(chrono, records...)
+	}
+
+	speeds := trackSpeeds(records)
+	var ep *speedEpisode // Current period exceeding the limit
+	var prev *ds.GPS
+	for _, r := range records {
+		isNew := r.Created.After(a.SpeedChecked) // Records already processed do not change the state
+		// A Stop event or a long gap without records ends the episode
+		if r.Evt() == ds.EvtStop || prev != nil && r.Created.Sub(prev.Created) > speedDarkTimeout {
+			ep = nil
+			if isNew && !a.SpeedEpisode.IsZero() {
+				c.Infof("Device stopped or went dark, speeding episode ended.")
+				a.SpeedEpisode = time.Time{}
+			}
+		}
+		prev = r
+		v, ok := speeds[r]
+		if !ok {
+			continue
+		}
+		if v > float64(limit) {
+			if ep == nil {
+				ep = &speedEpisode{Start: r.Created}
+			}
+			if v > ep.PeakV {
+				ep.Peak, ep.PeakV = r, v
+			}
+			if isNew && a.SpeedEpisode.IsZero() && r.Created.Sub(ep.Start) >= sustain {
+				c.Infof("Speeding episode started.")
+				a.SpeedEpisode = ep.Start
+			}
+			continue
+		}
+		ep = nil
+		if isNew && !a.SpeedEpisode.IsZero() {
+			c.Infof("Speed dropped below the limit, speeding episode ended.")
+			a.SpeedEpisode = time.Time{}
+		}
+	}
+	if len(records) > 0 {
+		a.SpeedChecked = records[len(records)-1].Created
+	}
+
+	if a.SpeedEpisode.IsZero() {
+		c.Infof("No speeding episode. Ok.")
+		return nil, nil
+	}
+
+	c.Warningf("Device exceeding %d km/h for %d seconds!", limit, seconds)
+	latest, err := getDevRecords(c, a.DevID)
+	if err != nil {
+		return nil, err
+	}
+	// Peak is only known if the records of this check exceed the limit
+	peak, loc, mapURL := "unknown", "unknown", "-"
+	var positions []ds.Position
+	if ep != nil {
+		positions = histPositions([]*ds.GPS{ep.Peak})
+		gp := ep.Peak.GeoPoint
+		peak = fmt.Sprintf("%.1f km/h", ep.PeakV)
+		loc = fmt.Sprintf("%f,%f", gp.Lat, gp.Lng)
+		mapURL = maps.Current().ViewURL(maps.Center(gp.Lat, gp.Lng), 15)
+	}
+	name := devName(c, accKeyID, a.DevID)
+	return &alertFiring{Msg: name + " is speeding!", BodyTempl: speedingAlertMail, Records: latest, Positions: positions,
+		Args: []interface{}{name, limit, seconds, a.SpeedEpisode.UTC().Format(timeLayoutMail), peak, loc, mapURL}}, nil
+}
+
+// trackSpeeds returns the speeds of the Track records of the specified records (must be in chronological order)
+// in km/h, mapped from the records: the speed reported by the device if available, else the speed calculated
+// from the distance and time elapsed since the previous Track record (the same way checkHijack() does).
+// Records without a reported speed and a previous Track record are not included.
+func trackSpeeds(records []*ds.GPS) map[*ds.GPS]float64 {
+	speeds := make(map[*ds.GPS]float64, len(records))
+	var prev *ds.GPS
+	for _, r := range records {
+		if !r.Track() {
+			continue
+		}
+		if r.HasSpeed {
+			speeds[r] = r.Speed
+		} else if prev != nil {
+			if dt := r.Created.Sub(prev.Created); dt > 0 {
+				dd := logic.Distance(prev.GeoPoint.Lat, prev.GeoPoint.Lng, r.GeoPoint.Lat, r.GeoPoint.Lng) // [m]
+				speeds[r] = float64(dd) / dt.Seconds() * 3.6
+			}
+		}
+		prev = r
+	}
+	return speeds
+}
+
+// saveAlert saves the state of the specified alert of the account with the specified id (e.g. after its checker
+// changed it). Only the fields owned by the alert check are saved onto the stored alert, the others may have been
+// changed by the user meanwhile (on the Alerts and AlertAck pages), and the alert was loaded by a non-ancestor query.
+// The alert is not saved if it has been deleted meanwhile, or if its parameters have been changed
+// (the state of the check belongs to the old parameters, see logic.updateAlert()).
+func saveAlert(c appengine.Context, a *ds.Alert, accKeyID int64) error {
+	key := datastore.NewKey(c, ds.ENameAlert, "", a.KeyID, datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil))
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var stored ds.Alert
+		if err := datastore.Get(tc, key, &stored); err != nil {
+			return err // datastore.ErrNoSuchEntity if deleted
+		}
+		if stored.GetType() != a.GetType() || stored.Params != a.Params {
+			c.Infof("Alert edited meanwhile, state not saved.")
+			return nil
+		}
+		stored.SpeedEpisode, stored.SpeedChecked, stored.EventsNotified = a.SpeedEpisode, a.SpeedChecked, a.EventsNotified
+		stored.State, stored.StateSince, stored.LastNotified, stored.LastMsg = a.State, a.StateSince, a.LastNotified, a.LastMsg
+		stored.HistID = a.HistID
+		if stored.Secret == "" {
+			stored.Secret = a.Secret
+		}
+		_, err := datastore.Put(tc, key, &stored)
+		return err
+	}, nil)
+}
+
+// devName returns the name of the device with the specified id of the specified account.
+// Returns the device id if the device list can't be loaded.
+func devName(c appengine.Context, accKeyID, devKeyID int64) string {
+	devices, err := cache.GetDevListForAccKey(c, datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil))
+	if err != nil {
+		c.Errorf("Failed to load devices: %v", err)
+	}
+	for _, d := range devices {
+		if d.KeyID == devKeyID {
+			return d.Name
+		}
+	}
+	return fmt.Sprint(devKeyID)
 }
 
 // getDeviceRecords returns the latest GPS records of the device with the specified id.
@@ -193,7 +962,7 @@ func getDevRecords(c appengine.Context, devKeyID int64) ([]*ds.GPS, error) {
 
 	var rs = make([]*ds.GPS, 0, pageSize)
 	if _, err := q.GetAll(c, &rs); err != nil {
-		c.Errorf("Failed to get latest car GPS records for device id: %d: %v", devKeyID, err)
+		c.Errorf("Failed to get latest GPS records for device id: %d: %v", devKeyID, err)
 		return nil, err
 	}
 
@@ -206,11 +975,9 @@ func getDevRecords(c appengine.Context, devKeyID int64) ([]*ds.GPS, error) {
 }
 
 // devMoved tells if a device moved based on the passed latest GPS records.
+// minDeltaDist is the min delta distance in meters that is considered moving.
 // At least 2 track GPS records must be present to report moving (to return true).
-func devMoved(rs []*ds.GPS) bool {
-	// Min delta distance that is considered moving
-	const minDeltaDist = 230 // [m]
-
+func devMoved(rs []*ds.GPS, minDeltaDist int64) bool {
 	var first, last *ds.GPS // First and Last track records
 
 	for _, r := range rs {
@@ -241,56 +1008,247 @@ func devMoved(rs []*ds.GPS) bool {
 	return false
 }
 
-// sendAlert sends an alert email about the potential car hijacking.
-func sendAlert(c appengine.Context, accKeyID int64, alertMsg, bodyTempl string) {
-	// load account
-	acc := new(ds.Account)
-	key := datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil)
-	if err := datastore.Get(c, key, acc); err != nil {
-		c.Errorf("Failed to load account: %v", err)
-		return
+// sendAlert sends the notification of the specified alert history entry (of the kind of the entry) with the specified
+// alert message to the channels of the specified alert (see alertChannels()), and returns the notification attempts.
+// The body is produced by formatting bodyTempl with the email of the account followed by args,
+// followed by the specified acknowledge links (see ackLinks()) and the signature.
+// A map of the specified latest GPS records (in reverse chronological order) is attached
+// as a KMZ file (if there are records).
+func sendAlert(c appengine.Context, run *alertRun, a *ds.Alert, accKeyID int64, h *ds.AlertHist, alertMsg, bodyTempl, links string, records []*ds.GPS, args ...interface{}) []*ds.Notification {
+	acc, err := run.account(c, accKeyID)
+	if err != nil {
+		return nil
 	}
+	channels, err := alertChannels(c, a, acc)
+	if err != nil {
+		return nil
+	}
+	accKey := acc.GetKey(c)
+	if h.KeyID == 0 {
+		// Pending notifications are saved before the history entry (see notifyChannel()), they need its key ID
+		low, _, err := datastore.AllocateIDs(c, ds.ENameAlertHist, accKey, 1)
+		if err != nil {
+			c.Errorf("Failed to allocate alert history ID: %v", err)
+			return nil
+		}
+		h.KeyID = low
+	}
+	kind := h.Kind
 
-	const adminEmail = "Andras Belicza <iczaaa@gmail.com>"
-	msg := &mail.Message{
-		Sender:  adminEmail,
-		To:      []string{acc.Email},
-		ReplyTo: adminEmail,
-		Subject: "[IczaGPS] ALERT: " + alertMsg,
-		Body:    fmt.Sprintf(bodyTempl, acc.Email),
+	msg := &notify.Message{
+		Subject: strings.ToUpper(kind) + ": " + alertMsg,
+		Body:    fmt.Sprintf(bodyTempl, append([]interface{}{acc.Email}, args...)...) + links + mailSignature,
+		Event: &notify.Event{Kind: kind, AlertID: a.KeyID, Type: a.GetType(), Message: alertMsg,
+			DeviceID: a.DevID, Device: devName(c, accKeyID, a.DevID), Time: time.Now()},
 	}
-	if len(acc.ContactEmail) > 0 {
-		msg.Cc = []string{acc.ContactEmail}
+	for _, r := range records {
+		if r.Track() {
+			msg.Event.Position = &notify.Position{Lat: r.GeoPoint.Lat, Lng: r.GeoPoint.Lng, Time: r.Created}
+			break
+		}
 	}
-	if err := mail.Send(c, msg); err == nil {
-		c.Infof("Sent successful alert email: %s", alertMsg)
-	} else {
-		c.Errorf("Couldn't send alert email: %s, %v", alertMsg, err)
+	if len(records) > 0 {
+		if kmz, err := alertMapKMZ(msg.Event.Device, records, msg.Event.Time); err == nil {
+			msg.Attachments = []notify.Attachment{{Name: "map.kmz", Data: kmz}}
+		} else {
+			c.Warningf("Failed to render alert map: %v", err)
+		}
 	}
+
+	ntfs := make([]*ds.Notification, len(channels))
+	for i, ch := range channels {
+		n := &ds.Notification{HistID: h.KeyID, AlertID: a.KeyID, Kind: kind, ChannelID: ch.id, Channel: ch.name, Recipient: ch.recipient, Created: h.Created}
+		ntfs[i] = n
+		if err := notifyChannel(c, accKey, ch, msg, n); err != nil {
+			c.Errorf("Couldn't send alert notification via %s to %s: %s, %v", ch.name, ch.recipient, msg.Subject, err)
+			n.Error = err.Error()
+			continue
+		}
+		if n.Pending {
+			c.Infof("Queued alert notification via %s to %s: %s", ch.name, ch.recipient, msg.Subject)
+			continue
+		}
+		n.Success = true
+		c.Infof("Sent successful alert notification via %s to %s: %s", ch.name, ch.recipient, msg.Subject)
+	}
+	return ntfs
 }
 
-const carGoneDarkAlertMail = `Hi %s,
+// notifyChannel sends the specified message over the specified channel, the specified notification attempt
+// is the entry of the notification log. Queued deliveries record their result in the log entry,
+// so it is saved as pending (under the specified account key) in the transaction that queues the delivery.
+func notifyChannel(c appengine.Context, accKey *datastore.Key, ch alertChannel, msg *notify.Message, n *ds.Notification) error {
+	if !ch.queued {
+		return ch.Notify(c, msg)
+	}
 
-WARNING: POTENTIAL CAR HIJACKING!
+	m := *msg
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		n.Pending = true
+		key, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, ds.ENameNotification, accKey), n)
+		if err != nil {
+			return err
+		}
+		n.KeyID, m.LogKey = key.IntID(), key
+		return ch.Notify(tc, &m)
+	}, nil)
+	if err != nil {
+		// Nothing is saved nor queued
+		n.Pending, n.KeyID = false, 0
+	}
+	return err
+}
+
+// alertChannel is a notification channel of an alert, delivering to a recipient.
+type alertChannel struct {
+	// Key ID and name of the channel
+	id   int64
+	name string
+
+	// Recipient of the notifications (for the notification log)
+	recipient string
+
+	// Tells if the deliveries are queued (their results are recorded by the delivery task)
+	queued bool
+
+	notify.Notifier
+}
+
+// alertChannels returns the notification channels of the specified alert of the specified account.
+// Alerts not routed to any channels (and alerts whose channels are all gone) are sent to the account emails.
+// Gateway channels are split into one channel per recipient, so notification attempts are logged per recipient.
+func alertChannels(c appengine.Context, a *ds.Alert, acc *ds.Account) ([]alertChannel, error) {
+	channels, err := cache.GetChannelListForAccKey(c, acc.GetKey(c))
+	if err != nil {
+		c.Errorf("Failed to load channels: %v", err)
+		return nil, err
+	}
 
-This is an alert email to let you know that your car GPS device has gone dark for more than 5 minutes now!
+	var achs []alertChannel
+	add := func(id int64, name string, n notify.Notifier) {
+		switch n := n.(type) {
+		case *notify.Email:
+			achs = append(achs, alertChannel{id, name, strings.Join(append(append([]string{}, n.To...), n.Cc...), ", "), false, n})
+		case *notify.Webhook:
+			achs = append(achs, alertChannel{id, name, n.URL, true, n})
+		case *notify.Gateway:
+			for _, r := range n.Recipients {
+				g := *n
+				g.Recipients = []string{r}
+				achs = append(achs, alertChannel{id, name, r, true, &g})
+			}
+		}
+	}
 
-You can visit IczaGPS here:
+	for _, id := range a.Channels {
+		if id == ds.ChannelAccountEmail {
+			add(id, "account email", notify.ForAccount(acc))
+			continue
+		}
+		var n notify.Notifier
+		for _, ch := range channels {
+			if ch.KeyID == id {
+				if n = notify.ForChannel(ch); n != nil {
+					add(id, ch.Name, n)
+				}
+			}
+		}
+		if n == nil {
+			c.Warningf("Channel not found or invalid! id: %d", id)
+		}
+	}
+	if len(achs) == 0 {
+		add(ds.ChannelAccountEmail, "account email", notify.ForAccount(acc))
+	}
+	return achs, nil
+}
+
+// alertMapKMZ returns the specified GPS records (in reverse chronological order) of the device
+// with the specified name as a KMZ map to be attached to alert emails.
+// KMZ is used because Mail only accepts attachments of certain types, SVG images are not allowed.
+func alertMapKMZ(devName string, records []*ds.GPS, t time.Time) ([]byte, error) {
+	chrono := make([]*ds.GPS, len(records))
+	for i, r := range records {
+		chrono[len(records)-1-i] = r
+	}
+
+	buf := &bytes.Buffer{}
+	if err := logic.WriteRecordsKMZ(buf, devName, chrono, t); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Signature of alert emails.
+const mailSignature = `You can visit IczaGPS here:
 https://iczagps.appspot.com
 
 Best Regards,
 Andras Belicza
 `
 
+const carGoneDarkAlertMail = `Hi %s,
+
+WARNING: POTENTIAL CAR HIJACKING!
+
+This is an alert email to let you know that your car GPS device has gone dark for more than %d minutes now!
+The last known locations of your car are attached (map.kmz, open it with Google Earth).
+
+`
+
+const devGoneDarkAlertMail = `Hi %s,
+
+WARNING: GPS DEVICE GONE DARK!
+
+This is an alert email to let you know that your GPS device "%s" has gone dark for more than %d minutes now!
+The last known locations of your device are attached (map.kmz, open it with Google Earth).
+
+`
+
+const geofenceAlertMail = `Hi %s,
+
+WARNING: GEOFENCE CROSSED!
+
+This is an alert email to let you know that your GPS device "%s" has %s the geofence "%s"!
+Time of the crossing: %s
+Location of the crossing: %f,%f
+Number of crossings alerted on not yet notified: %d
+
+The latest locations of your device are attached (map.kmz, open it with Google Earth).
+
+`
+
+const speedingAlertMail = `Hi %s,
+
+WARNING: SPEEDING!
+
+This is an alert email to let you know that your GPS device "%s" has exceeded the speed limit of %d km/h for at least %d seconds!
+Speeding since: %s
+Peak speed: %s
+Location of the peak speed: %s
+View it on a map: %s
+
+The latest locations of your device are attached (map.kmz, open it with Google Earth).
+
+`
+
 const carMovingWithoutYouMail = `Hi %s,
 
 WARNING: POTENTIAL CAR HIJACKING!
 
 This is an alert email to let you know that your car GPS device is moving without your personal mobile!
+The latest locations of your car are attached (map.kmz, open it with Google Earth).
 
-You can visit IczaGPS here:
-https://iczagps.appspot.com
+`
+
+const resolvedAlertMail = `Hi %s,
+
+RESOLVED: %s
+
+This is an email to let you know that the above alert has been resolved, it is no longer firing.
+Firing since: %s
+Resolved at: %s
+
+The latest locations of your device are attached (map.kmz, open it with Google Earth).
 
-Best Regards,
-Andras Belicza
 `
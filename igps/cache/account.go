@@ -12,6 +12,7 @@ import (
 	"appengine/user"
 	"igps/ds"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -114,3 +115,84 @@ func CacheAccount(c appengine.Context, acc *ds.Account) {
 		c.Warningf("Failed to set %s in memcache: %v", mk, err)
 	}
 }
+
+// GetAccountForAPIToken returns the Account for the specified API token.
+// The Key ID of the Account is cached (memcache), the Account itself is always loaded from the Datastore
+// by key (strongly consistent) so changes of the Account are seen immediately.
+//
+// If there is no Account for the specified API token, nil is returned as acc,
+// and it is not considered an error (err will be nil).
+func GetAccountForAPIToken(c appengine.Context, token string) (acc *ds.Account, err error) {
+	if token == "" {
+		// Empty token means API access is disabled, do not match those accounts!
+		return nil, nil
+	}
+
+	// First check in memcache:
+	mk := prefixAccKeyIDForAPIToken + token
+
+	var keyID int64
+
+	var item *memcache.Item
+	if item, err = memcache.Get(c, mk); err == nil {
+		// Found in memcache
+		if len(item.Value) == 0 {
+			// This means that the token is invalid, but was stored in the memcache
+			// to prevent query repeating.
+			return nil, nil
+		}
+		keyID, _ = strconv.ParseInt(string(item.Value), 10, 64)
+	} else {
+		// If err == memcache.ErrCacheMiss it's just not present,
+		// else real Error (e.g. memcache service is down).
+		if err != memcache.ErrCacheMiss {
+			c.Errorf("Failed to get %s from memcache: %v", mk, err)
+		}
+
+		q := datastore.NewQuery(ds.ENameAccount).Filter(ds.PNameAPIToken+"=", token).KeysOnly().Limit(1)
+		var accKeys []*datastore.Key
+		if accKeys, err = q.GetAll(c, nil); err != nil {
+			// Datastore error.
+			c.Errorf("Failed to query Accounts by APIToken: %v", err)
+			return nil, err
+		}
+
+		var value []byte
+		if len(accKeys) > 0 {
+			keyID = accKeys[0].IntID()
+			value = []byte(strconv.FormatInt(keyID, 10))
+		}
+		// Also store it in memcache (store an empty value for invalid tokens to prevent query repeating):
+		if err = memcache.Set(c, &memcache.Item{Key: mk, Value: value}); err != nil {
+			c.Warningf("Failed to set %s in memcache: %v", mk, err)
+		}
+		if keyID == 0 {
+			return nil, nil
+		}
+	}
+
+	acc = new(ds.Account)
+	if err = datastore.Get(c, datastore.NewKey(c, ds.ENameAccount, "", keyID, nil), acc); err != nil {
+		// Datastore error.
+		c.Errorf("Failed to lookup Account by Key: %v", err)
+		return nil, err
+	}
+	acc.KeyID = keyID
+
+	// Token might have been changed since it was cached:
+	if acc.APIToken != token {
+		ClearAccKeyIDForAPIToken(c, token)
+		return nil, nil
+	}
+
+	return acc, nil
+}
+
+// ClearAccKeyIDForAPIToken clears the cached Account Key ID for the specified API token.
+func ClearAccKeyIDForAPIToken(c appengine.Context, token string) {
+	mk := prefixAccKeyIDForAPIToken + token
+
+	if err := memcache.Delete(c, mk); err != nil {
+		c.Warningf("Failed to delete %s from memcache: %v", mk, err)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+This file implements data access of Channel List from the Datastore
+which are also cached and retrieved from the memcache is present.
+*/
+
+package cache
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"igps/ds"
+	"strconv"
+)
+
+// GetChannelListForAccKey returns the Channel list for the specified Account, ordered by name.
+// The implementation applies caching: first memcache is checked if the Channel list is already stored
+// which is returned if so. Else the Channel list is read from the Datastore and the list is put into the memcache
+// before returning it.
+//
+// If there is no Channel for the specified Account, nil is returned as the channels,
+// and it is not considered an error (err will be nil).
+func GetChannelListForAccKey(c appengine.Context, accKey *datastore.Key) (channels []*ds.Channel, err error) {
+	// First check in memcache:
+	mk := prefixChannelListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	var item *memcache.Item
+	if item, err = memcache.Get(c, mk); err == nil {
+		// Found in memcache
+		var channels []*ds.Channel
+		err = json.Unmarshal(item.Value, &channels)
+		if err != nil {
+			c.Errorf("Invalid ChannelList value stored in memcache: %s", item.Value)
+			return nil, err
+		}
+		return channels, nil
+	}
+
+	// If err == memcache.ErrCacheMiss it's just not present,
+	// else real Error (e.g. memcache service is down).
+	if err != memcache.ErrCacheMiss {
+		c.Errorf("Failed to get %s from memcache: %v", mk, err)
+	}
+
+	// Either way we have to search in Datastore:
+
+	q := datastore.NewQuery(ds.ENameChannel).Ancestor(accKey).Order(ds.PNameName)
+
+	var chKeys []*datastore.Key
+	if chKeys, err = q.GetAll(c, &channels); err != nil {
+		// Datastore error.
+		c.Errorf("Failed to query Channel list by ancestor: %v", err)
+		return nil, err
+	}
+	for i := range channels {
+		channels[i].KeyID = chKeys[i].IntID()
+	}
+
+	// Also store it in memcache
+	cacheChannelListForAccKey(c, accKey, channels)
+
+	return channels, nil
+}
+
+// cacheChannelListForAccKey puts the specified Channel list into the cache (memcache).
+func cacheChannelListForAccKey(c appengine.Context, accKey *datastore.Key, channels []*ds.Channel) {
+	mk := prefixChannelListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	data, err := json.Marshal(channels) // This can't really fail
+	if err != nil {
+		c.Errorf("Failed to encode channel list to JSON: %v", err)
+	}
+
+	if err = memcache.Set(c, &memcache.Item{Key: mk, Value: data}); err != nil {
+		c.Warningf("Failed to set %s in memcache: %v", mk, err)
+	}
+}
+
+// ClearChannelListForAccKey clears the cached Channel list for the specified Account Key.
+func ClearChannelListForAccKey(c appengine.Context, accKey *datastore.Key) {
+	mk := prefixChannelListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+	if err := memcache.Delete(c, mk); err != nil {
+		c.Warningf("Failed to delete %s from memcache: %v", mk, err)
+	}
+}
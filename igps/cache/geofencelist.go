@@ -0,0 +1,86 @@
+/*
+This file implements data access of Geofence List from the Datastore
+which are also cached and retrieved from the memcache is present.
+*/
+
+package cache
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"igps/ds"
+	"strconv"
+)
+
+// GetGeofenceListForAccKey returns the Geofence list for the specified Account, ordered by name.
+// The implementation applies caching: first memcache is checked if the Geofence list is already stored
+// which is returned if so. Else the Geofence list is read from the Datastore and the list is put into the memcache
+// before returning it.
+//
+// If there is no Geofence for the specified Account, nil is returned as the geofences,
+// and it is not considered an error (err will be nil).
+func GetGeofenceListForAccKey(c appengine.Context, accKey *datastore.Key) (geofences []*ds.Geofence, err error) {
+	// First check in memcache:
+	mk := prefixGeofenceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	var item *memcache.Item
+	if item, err = memcache.Get(c, mk); err == nil {
+		// Found in memcache
+		var geofences []*ds.Geofence
+		err = json.Unmarshal(item.Value, &geofences)
+		if err != nil {
+			c.Errorf("Invalid GeofenceList value stored in memcache: %s", item.Value)
+			return nil, err
+		}
+		return geofences, nil
+	}
+
+	// If err == memcache.ErrCacheMiss it's just not present,
+	// else real Error (e.g. memcache service is down).
+	if err != memcache.ErrCacheMiss {
+		c.Errorf("Failed to get %s from memcache: %v", mk, err)
+	}
+
+	// Either way we have to search in Datastore:
+
+	q := datastore.NewQuery(ds.ENameGeofence).Ancestor(accKey).Order(ds.PNameName)
+
+	var gfKeys []*datastore.Key
+	if gfKeys, err = q.GetAll(c, &geofences); err != nil {
+		// Datastore error.
+		c.Errorf("Failed to query Geofence list by ancestor: %v", err)
+		return nil, err
+	}
+	for i := range geofences {
+		geofences[i].KeyID = gfKeys[i].IntID()
+	}
+
+	// Also store it in memcache
+	cacheGeofenceListForAccKey(c, accKey, geofences)
+
+	return geofences, nil
+}
+
+// cacheGeofenceListForAccKey puts the specified Geofence list into the cache (memcache).
+func cacheGeofenceListForAccKey(c appengine.Context, accKey *datastore.Key, geofences []*ds.Geofence) {
+	mk := prefixGeofenceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	data, err := json.Marshal(geofences) // This can't really fail
+	if err != nil {
+		c.Errorf("Failed to encode geofence list to JSON: %v", err)
+	}
+
+	if err = memcache.Set(c, &memcache.Item{Key: mk, Value: data}); err != nil {
+		c.Warningf("Failed to set %s in memcache: %v", mk, err)
+	}
+}
+
+// ClearGeofenceListForAccKey clears the cached Geofence list for the specified Account Key.
+func ClearGeofenceListForAccKey(c appengine.Context, accKey *datastore.Key) {
+	mk := prefixGeofenceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+	if err := memcache.Delete(c, mk); err != nil {
+		c.Warningf("Failed to delete %s from memcache: %v", mk, err)
+	}
+}
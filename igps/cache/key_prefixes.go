@@ -10,9 +10,21 @@ const (
 	// Memcache key prefix for Account for User ID.
 	prefixAccForUID = "accForUID:"
 
+	// Memcache key prefix for Account Key ID for API token.
+	prefixAccKeyIDForAPIToken = "accKeyIDForAPIToken:"
+
 	// Memcache key prefix for Device for RandID
 	prefixDevForRandID = "devForRandID:"
 
 	// Memcache key prefix for Device list for an Account Key
 	prefixDevListForAccKey = "devListForAccKey:"
+
+	// Memcache key prefix for Place list for an Account Key
+	prefixPlaceListForAccKey = "placeListForAccKey:"
+
+	// Memcache key prefix for Geofence list for an Account Key
+	prefixGeofenceListForAccKey = "geofenceListForAccKey:"
+
+	// Memcache key prefix for Channel list for an Account Key
+	prefixChannelListForAccKey = "channelListForAccKey:"
 )
@@ -0,0 +1,86 @@
+/*
+This file implements data access of Place List from the Datastore
+which are also cached and retrieved from the memcache is present.
+*/
+
+package cache
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"igps/ds"
+	"strconv"
+)
+
+// GetPlaceListForAccKey returns the Place list for the specified Account, ordered by name.
+// The implementation applies caching: first memcache is checked if the Place list is already stored
+// which is returned if so. Else the Place list is read from the Datastore and the list is put into the memcache
+// before returning it.
+//
+// If there is no Place for the specified Account, nil is returned as the places,
+// and it is not considered an error (err will be nil).
+func GetPlaceListForAccKey(c appengine.Context, accKey *datastore.Key) (places []*ds.Place, err error) {
+	// First check in memcache:
+	mk := prefixPlaceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	var item *memcache.Item
+	if item, err = memcache.Get(c, mk); err == nil {
+		// Found in memcache
+		var places []*ds.Place
+		err = json.Unmarshal(item.Value, &places)
+		if err != nil {
+			c.Errorf("Invalid PlaceList value stored in memcache: %s", item.Value)
+			return nil, err
+		}
+		return places, nil
+	}
+
+	// If err == memcache.ErrCacheMiss it's just not present,
+	// else real Error (e.g. memcache service is down).
+	if err != memcache.ErrCacheMiss {
+		c.Errorf("Failed to get %s from memcache: %v", mk, err)
+	}
+
+	// Either way we have to search in Datastore:
+
+	q := datastore.NewQuery(ds.ENamePlace).Ancestor(accKey).Order(ds.PNameName)
+
+	var placeKeys []*datastore.Key
+	if placeKeys, err = q.GetAll(c, &places); err != nil {
+		// Datastore error.
+		c.Errorf("Failed to query Place list by ancestor: %v", err)
+		return nil, err
+	}
+	for i := range places {
+		places[i].KeyID = placeKeys[i].IntID()
+	}
+
+	// Also store it in memcache
+	cachePlaceListForAccKey(c, accKey, places)
+
+	return places, nil
+}
+
+// cachePlaceListForAccKey puts the specified Place list into the cache (memcache).
+func cachePlaceListForAccKey(c appengine.Context, accKey *datastore.Key, places []*ds.Place) {
+	mk := prefixPlaceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+
+	data, err := json.Marshal(places) // This can't really fail
+	if err != nil {
+		c.Errorf("Failed to encode place list to JSON: %v", err)
+	}
+
+	if err = memcache.Set(c, &memcache.Item{Key: mk, Value: data}); err != nil {
+		c.Warningf("Failed to set %s in memcache: %v", mk, err)
+	}
+}
+
+// ClearPlaceListForAccKey clears the cached Place list for the specified Account Key.
+func ClearPlaceListForAccKey(c appengine.Context, accKey *datastore.Key) {
+	mk := prefixPlaceListForAccKey + strconv.FormatInt(accKey.IntID(), 10)
+	if err := memcache.Delete(c, mk); err != nil {
+		c.Warningf("Failed to delete %s from memcache: %v", mk, err)
+	}
+}
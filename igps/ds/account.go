@@ -8,6 +8,7 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"encoding/json"
+	"igps/maps"
 	"strconv"
 	"strings"
 	"sync"
@@ -51,6 +52,23 @@ type Account struct {
 	// Logs Page Size
 	LogsPageSize int `datastore:"lps" json:"lps"`
 
+	// Map preview provider, one of MapPrevProviders.
+	MapPrevProvider string `datastore:"mpp" json:"mpp"`
+
+	// Map type of map previews, one of maps.MapTypes.
+	MapType string `datastore:"mt" json:"mt"`
+
+	// Zoom level of map previews of locations.
+	MapZoom int `datastore:"mz" json:"mz"`
+
+	// API token to access the account's data without logging in (e.g. the GeoJSON feed).
+	// Empty means API access is disabled. Can be changed (regenerated).
+	APIToken string `datastore:"tok" json:"tok"`
+
+	// Quiet hours: weekly time windows (in the time zone of the account) when only critical alerts are delivered,
+	// see ParseSchedule(). Empty means no quiet hours.
+	QuietHours string `datastore:"qh" json:"qh"`
+
 	// Timestamp
 	Created time.Time `datastore:"t" json:"t"`
 
@@ -64,6 +82,23 @@ type Account struct {
 	location *time.Location `datastore:"-" json:"-"`
 }
 
+// Map preview providers.
+const (
+	// Google Static Maps API
+	MapPrevGoogle = ""
+
+	// Built-in SVG renderer (works without an external map API)
+	MapPrevSVG = "svg"
+)
+
+// Valid map preview providers.
+var MapPrevProviders = []string{MapPrevGoogle, MapPrevSVG}
+
+// SVGMapPrev tells if map previews are to be rendered as SVG images.
+func (a *Account) SVGMapPrev() bool {
+	return a.MapPrevProvider == MapPrevSVG
+}
+
 // Encode encodes the Account into a []byte using JSON.
 func (a *Account) Encode() []byte {
 	b, err := json.Marshal(a) // This can't really fail...
@@ -89,6 +124,18 @@ func (a *Account) Location() *time.Location {
 	return a.location
 }
 
+// InQuietHours tells if the specified time is inside the quiet hours of the account.
+func (a *Account) InQuietHours(t time.Time) bool {
+	if a.QuietHours == "" {
+		return false
+	}
+	sc, err := ParseSchedule(a.QuietHours)
+	if err != nil {
+		return false // Validated when saved, this can't really happen...
+	}
+	return sc.Contains(t.In(a.Location()))
+}
+
 // GetLogsPageSize returns the Logs Page Size.
 func (a *Account) GetLogsPageSize() int {
 	// Default value:
@@ -142,6 +189,24 @@ func (a *Account) GetMobMapImgFormat() string {
 	return a.MobMapImgFormat
 }
 
+// GetMapType returns the map type of map previews.
+func (a *Account) GetMapType() string {
+	// Default value:
+	if a.MapType == "" {
+		return maps.MapTypeRoadmap
+	}
+	return a.MapType
+}
+
+// GetMapZoom returns the zoom level of map previews of locations.
+func (a *Account) GetMapZoom() int {
+	// Default value:
+	if a.MapZoom == 0 {
+		return 16
+	}
+	return a.MapZoom
+}
+
 // GetKey returns a newly created complete Key of the Account.
 func (a *Account) GetKey(c appengine.Context) *datastore.Key {
 	return datastore.NewKey(c, ENameAccount, "", a.KeyID, nil)
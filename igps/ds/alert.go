@@ -12,28 +12,137 @@ import (
 // Name of the Datastore Alert entity
 const ENameAlert = "Alr"
 
-// Alert type.
+// States of alerts.
+const (
+	// Not firing (the initial state)
+	StateOK = "ok"
+
+	// Firing, the condition of the rule is met
+	StateFiring = "firing"
+
+	// Was firing, but the condition of the rule is no longer met
+	StateResolved = "resolved"
+)
+
+// Alert type: an alert rule configured for a device.
+// The rule type determines what is checked, its parameters are stored in the Alert (see RuleTypes).
 type Alert struct {
-	// Car Device key ID.
-	CarDevID int64 `datastore:"cdid"`
+	// Rule type name (one of RuleXXX). Empty for alerts created before rule types, see GetType().
+	Type string `datastore:"ty"`
+
+	// Monitored Device key ID.
+	DevID int64 `datastore:"cdid"`
 
 	// Personal Mobile Device key ID.
+	// Only set in alerts created before rule types, it is the "persMob" parameter of RuleHijack.
 	PersMobDevID int64 `datastore:"pdid"`
 
+	// Parameter values of the rule, JSON encoded (see ParamValues()).
+	Params string `datastore:"prm,noindex"`
+
 	// Timestamp
 	Created time.Time `datastore:"t"`
 
+	// Start of the current speeding episode (RuleSpeed only), zero if the speed has dropped back below the limit.
+	SpeedEpisode time.Time `datastore:"spe,noindex"`
+
+	// Time of the last GPS record processed by the speed check (RuleSpeed only).
+	SpeedChecked time.Time `datastore:"spc,noindex"`
+
+	// Time of the last event notified (event rule types, e.g. the last geofence crossing of RuleGeofence).
+	// Later events are pending, they are notified by the next notification. Zero if no events have been notified yet.
+	EventsNotified time.Time `datastore:"evn,noindex"`
+
+	// State of the alert, one of StateXXX. Empty for alerts not yet checked, see GetState().
+	State string `datastore:"st,noindex"`
+
+	// Time of the last state change.
+	StateSince time.Time `datastore:"sts,noindex"`
+
+	// Time of the last notification (alert, reminder or resolved).
+	LastNotified time.Time `datastore:"ntf,noindex"`
+
+	// Message of the last firing notification.
+	LastMsg string `datastore:"msg,noindex"`
+
+	// Key ID of the last alert history entry, continued by the evaluations which find the alert still firing
+	// without notifying it (see AlertHist.Until). 0 if there is no entry to continue.
+	HistID int64 `datastore:"hid,noindex"`
+
+	// Reminder interval in minutes: while firing, reminders are sent this often. 0 means no reminders.
+	Reminder int64 `datastore:"rmd,noindex"`
+
+	// Secret to sign the acknowledge links of the alert emails with (e.g. "It's me", "Snooze 2 hours").
+	Secret string `datastore:"sec,noindex"`
+
+	// Time of the last acknowledgement, see Acknowledged().
+	AckedAt time.Time `datastore:"ack,noindex"`
+
+	// No notifications are sent until this time, zero if not snoozed.
+	SnoozedUntil time.Time `datastore:"snz,noindex"`
+
+	// Weekly time windows (in the time zone of the account) when the alert is active, see ParseSchedule().
+	// Empty means always active.
+	Schedule string `datastore:"sch,noindex"`
+
+	// Critical alerts are also delivered during the quiet hours of the account.
+	Critical bool `datastore:"crit,noindex"`
+
+	// Key IDs of the notification channels the alert is routed to (see Channel), ChannelAccountEmail for the
+	// emails of the account. Empty means the emails of the account.
+	Channels []int64 `datastore:"chn,noindex"`
+
 	// ------------------------------------------------------------------------------
 	// Derived/computed fields
 
 	// ID field of the Alert's key.
 	KeyID int64 `datastore:"-"`
 
-	// Name of the car device.
-	CarDevName string `datastore:"-"`
+	// Name of the monitored device.
+	DevName string `datastore:"-"`
+
+	// Parameters of the rule formatted in a human readable format.
+	ParamTexts []string `datastore:"-"`
+}
+
+// GetState returns the state of the alert, StateOK for alerts not yet checked.
+func (a *Alert) GetState() string {
+	if a.State == "" {
+		return StateOK
+	}
+	return a.State
+}
+
+// Acknowledged tells if the alert is firing and it has been acknowledged since it started firing.
+func (a *Alert) Acknowledged() bool {
+	return a.GetState() == StateFiring && !a.AckedAt.Before(a.StateSince)
+}
+
+// Snoozed tells if the alert is snoozed at the specified time.
+func (a *Alert) Snoozed(t time.Time) bool {
+	return t.Before(a.SnoozedUntil)
+}
 
-	// Name of the personal mobile device.
-	PersMobDevName string `datastore:"-"`
+// Active tells if the specified time (in the time zone of the account) is inside the schedule of the alert.
+func (a *Alert) Active(t time.Time) bool {
+	if a.Schedule == "" {
+		return true
+	}
+	sc, err := ParseSchedule(a.Schedule)
+	if err != nil {
+		return true // Validated when saved, this can't really happen...
+	}
+	return sc.Contains(t)
+}
+
+// Reset resets the state of the alert and of its rule checks, as if it would have never been checked.
+// The alert is not notified of the conditions met before the reset.
+func (a *Alert) Reset(now time.Time) {
+	if a.GetState() == StateFiring {
+		a.State, a.StateSince = StateOK, now
+	}
+	a.SpeedEpisode, a.SpeedChecked = time.Time{}, time.Time{}
+	a.HistID = 0
 }
 
 // Encode encodes the Alert into a []byte using JSON.
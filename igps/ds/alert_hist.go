@@ -0,0 +1,97 @@
+/*
+Defines the AlertHist type.
+*/
+
+package ds
+
+import (
+	"appengine"
+	"time"
+)
+
+// Name of the Datastore AlertHist entity
+const ENameAlertHist = "AlrH"
+
+// Outcomes of alert evaluations.
+const (
+	// Notification sent (or queued for delivery) to at least one channel
+	OutcomeNotified = "notified"
+
+	// Notification failed on all channels (retried by the next check)
+	OutcomeFailed = "failed"
+
+	// Not notified: the alert is snoozed, acknowledged or the account is in quiet hours
+	OutcomeSuppressed = "suppressed"
+
+	// Still firing and already notified, no reminder is due
+	OutcomeOngoing = "ongoing"
+)
+
+// Outcomes is the slice of all alert evaluation outcomes.
+var Outcomes = []string{OutcomeNotified, OutcomeFailed, OutcomeSuppressed, OutcomeOngoing}
+
+// Retention of the alert history: older entries (and their notification attempts, and geofence crossings)
+// are deleted by the alert check.
+const AlertHistRetentionDays = 30
+
+// AlertHist type: an entry of the alert history, an alert evaluation which found the alert firing,
+// or which resolved it. Following evaluations finding the alert still firing without notifying it
+// continue the entry instead of adding new ones. The notification attempts of the evaluation are logged as Notification entities.
+// Alert history entries are stored under the Account as ancestor.
+type AlertHist struct {
+	// Key ID of the alert
+	AlertID int64 `datastore:"aid,noindex"`
+
+	// Rule type name of the alert (one of RuleXXX)
+	Type string `datastore:"ty,noindex"`
+
+	// Key ID of the monitored device
+	DevID int64 `datastore:"d,noindex"`
+
+	// Kind of the notification due (one of notify.KindXXX), empty if no notification was due
+	Kind string `datastore:"k,noindex"`
+
+	// Outcome of the evaluation, one of OutcomeXXX
+	Outcome string `datastore:"o,noindex"`
+
+	// Message of the alert
+	Msg string `datastore:"msg,noindex"`
+
+	// Reason of suppressed notifications (e.g. "snoozed")
+	Reason string `datastore:"rsn,noindex"`
+
+	// Positions of the device that triggered the alert (in reverse chronological order)
+	Positions []Position `datastore:"pos,noindex"`
+
+	// Time of the evaluation
+	Created time.Time `datastore:"t"`
+
+	// Time of the last evaluation continuing the entry, zero if none
+	Until time.Time `datastore:"u,noindex"`
+
+	// Number of evaluations continuing the entry
+	Repeats int `datastore:"rep,noindex"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// ID field of the AlertHist's key.
+	KeyID int64 `datastore:"-"`
+
+	// Name of the monitored device.
+	DevName string `datastore:"-"`
+
+	// Before filter of the Logs page listing the records preceding the evaluation.
+	LogsBefore string `datastore:"-"`
+
+	// Notification attempts of the evaluation.
+	Notifications []*Notification `datastore:"-"`
+}
+
+// Position is a reported position of a device.
+type Position struct {
+	GeoPoint appengine.GeoPoint `datastore:"g"`
+
+	// Time of the report
+	Time time.Time `datastore:"t"`
+}
@@ -0,0 +1,74 @@
+/*
+Defines the Channel type.
+*/
+
+package ds
+
+import (
+	"time"
+)
+
+// Name of the Datastore Channel entity
+const ENameChannel = "Chn"
+
+// Types of notification channels.
+const (
+	// Email to additional email addresses
+	ChannelEmail = "email"
+
+	// JSON payload posted to an HTTP(S) URL, signed with a shared secret
+	ChannelWebhook = "webhook"
+
+	// SMS sent through an HTTP gateway
+	ChannelSMS = "sms"
+
+	// Chat message sent through an HTTP gateway (e.g. a chat bot API)
+	ChannelChat = "chat"
+)
+
+// ChannelTypes is the slice of all notification channel types.
+var ChannelTypes = []string{ChannelEmail, ChannelWebhook, ChannelSMS, ChannelChat}
+
+// Gateway tells if the channel sends messages through an HTTP gateway.
+func (ch *Channel) Gateway() bool {
+	return ch.Type == ChannelSMS || ch.Type == ChannelChat
+}
+
+// ID of the implicit channel of the Account emails (email of the Account and the contact email).
+// It is not stored in the Datastore, and it is the channel of alerts not routed to any channels.
+const ChannelAccountEmail = 0
+
+// Channel type: a notification channel alerts can be routed to (see Alert.Channels).
+// Channels are stored under the Account as ancestor.
+type Channel struct {
+	// Channel name, unique (case-insensitive) in the Account
+	Name string `datastore:"nm" json:"nm"`
+
+	// Type of the channel, one of ChannelXXX
+	Type string `datastore:"ty,noindex" json:"ty"`
+
+	// Target of the channel: comma separated email addresses (ChannelEmail), the URL (ChannelWebhook)
+	// or the URL template of the gateway (ChannelSMS and ChannelChat)
+	Target string `datastore:"tg,noindex" json:"tg"`
+
+	// Shared secret to sign the payloads with (ChannelWebhook only)
+	Secret string `datastore:"sec,noindex" json:"sec"`
+
+	// Optional HTTP header to authenticate with at the gateway in "Name: value" format (ChannelSMS and ChannelChat only)
+	AuthHeader string `datastore:"auth,noindex" json:"auth"`
+
+	// Body template of the gateway requests (ChannelSMS and ChannelChat only)
+	BodyTemplate string `datastore:"body,noindex" json:"body"`
+
+	// Phone numbers (ChannelSMS) or chat IDs (ChannelChat) of the recipients
+	Recipients []string `datastore:"rcp,noindex" json:"rcp"`
+
+	// Timestamp
+	Created time.Time `datastore:"t,noindex" json:"-"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// ID field of the Channel's key.
+	KeyID int64 `datastore:"-"`
+}
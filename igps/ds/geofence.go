@@ -0,0 +1,97 @@
+/*
+Defines the Geofence, GeofenceState and GeofenceEvent types.
+*/
+
+package ds
+
+import (
+	"appengine"
+	"time"
+)
+
+// Name of the Datastore Geofence entity
+const ENameGeofence = "Gf"
+
+// Shapes of geofences.
+const (
+	// Circle given by a center and a radius
+	ShapeCircle = "circle"
+
+	// Polygon given by its vertices
+	ShapePolygon = "polygon"
+)
+
+// Geofence type: a user-defined area (a circle or a polygon) whose boundary crossings can be alerted on.
+// Geofences are stored under the Account as ancestor.
+type Geofence struct {
+	// Geofence name, unique (case-insensitive) in the Account
+	Name string `datastore:"nm" json:"nm"`
+
+	// Shape of the geofence, one of ShapeXXX
+	Shape string `datastore:"sh,noindex" json:"sh"`
+
+	// Center of the circle (ShapeCircle only)
+	GeoPoint appengine.GeoPoint `datastore:"g,noindex" json:"g"`
+
+	// Radius of the circle in meters (ShapeCircle only)
+	Radius int64 `datastore:"r,noindex" json:"r"`
+
+	// Vertices of the polygon (ShapePolygon only)
+	Points []appengine.GeoPoint `datastore:"pts,noindex" json:"pts"`
+
+	// Timestamp
+	Created time.Time `datastore:"t,noindex" json:"t"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// ID field of the Geofence's key.
+	KeyID int64 `datastore:"-"`
+}
+
+// Circle tells if the geofence is a circle.
+func (g *Geofence) Circle() bool {
+	return g.Shape != ShapePolygon
+}
+
+// Name of the Datastore GeofenceState entity
+const ENameGeofenceState = "GfS"
+
+// GeofenceState type: tells if a device is inside or outside of a geofence,
+// as of the last GPS record of the device processed by the alert check.
+// Stored under the Account as ancestor, with a key name of "<device key ID>-<geofence key ID>".
+type GeofenceState struct {
+	// Tells if the device is inside the geofence
+	Inside bool `datastore:"in,noindex"`
+
+	// Time of the last processed GPS record of the device
+	Time time.Time `datastore:"t,noindex"`
+}
+
+// Name of the Datastore GeofenceEvent entity
+const ENameGeofenceEvent = "GfE"
+
+// GeofenceEvent type: a crossing of the boundary of a geofence by a device, detected (and logged) by the alert check.
+// Stored under the Account as ancestor.
+type GeofenceEvent struct {
+	// Key ID of the device
+	DevKeyID int64 `datastore:"d"`
+
+	// Key ID of the geofence
+	GeofenceID int64 `datastore:"gf"`
+
+	// Event of the crossing: EvtEnter or EvtExit
+	Evt Event `datastore:"e,noindex"`
+
+	// Location of the GPS record the crossing was detected by
+	GeoPoint appengine.GeoPoint `datastore:"g,noindex"`
+
+	// Time of the GPS record the crossing was detected by
+	Created time.Time `datastore:"t"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// Names of the device and the geofence.
+	DevName, GeofenceName string `datastore:"-"`
+}
@@ -0,0 +1,52 @@
+/*
+Defines the Notification type.
+*/
+
+package ds
+
+import (
+	"time"
+)
+
+// Name of the Datastore Notification entity
+const ENameNotification = "Ntf"
+
+// Notification type: an entry of the notification log, an attempt to send an alert notification
+// to a recipient over a channel.
+// Notifications are stored under the Account as ancestor.
+type Notification struct {
+	// Key ID of the alert history entry (see AlertHist) of the evaluation which sent the notification
+	HistID int64 `datastore:"hid,noindex"`
+
+	// Key ID of the alert
+	AlertID int64 `datastore:"aid,noindex"`
+
+	// Kind of the notification, one of notify.KindXXX
+	Kind string `datastore:"k,noindex"`
+
+	// Key ID of the channel (ChannelAccountEmail for the emails of the Account) and its name
+	ChannelID int64  `datastore:"chid,noindex"`
+	Channel   string `datastore:"chn,noindex"`
+
+	// Recipient of the notification: email addresses, the URL of a webhook, or a phone number or chat ID
+	Recipient string `datastore:"rcp,noindex"`
+
+	// Tells if the notification was delivered
+	Success bool `datastore:"ok,noindex"`
+
+	// Tells if the delivery is queued and not yet finished (webhook and gateway deliveries are retried),
+	// the delivery task records the result
+	Pending bool `datastore:"pnd,noindex"`
+
+	// Error message of failed attempts (of the last failed delivery attempt if pending)
+	Error string `datastore:"err,noindex"`
+
+	// Time of the evaluation which sent the notification (same as the Created of the AlertHist)
+	Created time.Time `datastore:"t"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// ID field of the Notification's key, 0 if not yet saved.
+	KeyID int64 `datastore:"-"`
+}
@@ -0,0 +1,35 @@
+/*
+Defines the Place type.
+*/
+
+package ds
+
+import (
+	"appengine"
+	"time"
+)
+
+// Name of the Datastore Place entity
+const ENamePlace = "Pl"
+
+// Place type: a user-defined named location (e.g. home, office) with a radius.
+// Places are stored under the Account as ancestor.
+type Place struct {
+	// Place name, unique (case-insensitive) in the Account
+	Name string `datastore:"nm" json:"nm"`
+
+	// Center of the place
+	GeoPoint appengine.GeoPoint `datastore:"g,noindex" json:"g"`
+
+	// Radius of the place in meters
+	Radius int64 `datastore:"r,noindex" json:"r"`
+
+	// Timestamp
+	Created time.Time `datastore:"t,noindex" json:"t"`
+
+	// ------------------------------------------------------------------------------
+	// Derived/computed fields
+
+	// ID field of the Place's key.
+	KeyID int64 `datastore:"-"`
+}
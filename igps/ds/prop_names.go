@@ -22,4 +22,10 @@ const (
 
 	// AreaCodes property name
 	PNameAreaCodes = "a"
+
+	// APIToken property name
+	PNameAPIToken = "tok"
+
+	// GeofenceID property name
+	PNameGeofenceID = "gf"
 )
@@ -0,0 +1,250 @@
+/*
+Defines the alert rule types and their parameters.
+*/
+
+package ds
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Names of the alert rule types.
+const (
+	// Car hijack: the car device goes dark, or moves without the personal mobile device
+	RuleHijack = "hijack"
+
+	// The device goes dark: no reports for a given time
+	RuleDark = "dark"
+
+	// The device enters or exits a geofence
+	RuleGeofence = "geofence"
+
+	// The device exceeds a speed limit for a sustained duration
+	RuleSpeed = "speed"
+)
+
+// Geofence transitions triggering RuleGeofence alerts, values of its "trigger" parameter.
+const (
+	TriggerEnter int64 = 1 << iota // The device enters the geofence
+	TriggerExit                    // The device exits the geofence
+
+	TriggerBoth = TriggerEnter | TriggerExit // The device enters or exits the geofence
+)
+
+// ParamKind is the kind of a rule parameter.
+type ParamKind int
+
+// Kinds of rule parameters.
+const (
+	// Integer number in a range
+	ParamInt ParamKind = iota
+
+	// Key ID of a Device of the Account
+	ParamDevice
+
+	// Key ID of a Geofence of the Account
+	ParamGeofence
+
+	// One of a list of choices
+	ParamChoice
+)
+
+// Choice is a valid value of a ParamChoice rule parameter.
+type Choice struct {
+	Value int64
+	Label string
+}
+
+// RuleParam describes a parameter of an alert rule type.
+// Parameter values are int64 numbers (see Alert.ParamValues()).
+type RuleParam struct {
+	// Name of the parameter, the key in the parameter values
+	Name string
+
+	// Label and description displayed on the Alerts page
+	Label, Desc string
+
+	// Kind of the parameter
+	Kind ParamKind
+
+	// Unit of the value (ParamInt only), e.g. "min"
+	Unit string
+
+	// Default value and valid range (ParamInt only)
+	Def, Min, Max int64
+
+	// Tells if the parameter is optional (ParamDevice only, 0 means none)
+	Optional bool
+
+	// Valid values (ParamChoice only)
+	Choices []Choice
+}
+
+// Choice returns the label of the specified value of a ParamChoice parameter, empty string if v is not valid.
+func (rp *RuleParam) Choice(v int64) string {
+	for _, ch := range rp.Choices {
+		if ch.Value == v {
+			return ch.Label
+		}
+	}
+	return ""
+}
+
+// Format formats the specified value of the parameter in a human readable format.
+// devNames and gfNames hold the names of the devices and geofences mapped from their key IDs.
+func (rp *RuleParam) Format(v int64, devNames, gfNames map[int64]string) string {
+	switch rp.Kind {
+	case ParamDevice:
+		if v == 0 {
+			return "-"
+		}
+		return devNames[v]
+	case ParamGeofence:
+		return gfNames[v]
+	case ParamChoice:
+		return rp.Choice(v)
+	}
+	if rp.Unit == "" {
+		return fmt.Sprint(v)
+	}
+	return fmt.Sprintf("%d %s", v, rp.Unit)
+}
+
+// RuleType describes an alert rule type.
+type RuleType struct {
+	// Name of the rule type, stored in the Alert (one of RuleXXX)
+	Name string
+
+	// Title and description displayed on the Alerts page
+	Title, Desc string
+
+	// Label of the monitored device on the Alerts page
+	DevLabel string
+
+	// Tells if the rule type alerts on events (instead of conditions lasting for a while):
+	// every event is notified, and there are no reminders and resolved notifications.
+	Event bool
+
+	// Parameters of the rule type
+	Params []*RuleParam
+}
+
+// Param returns the parameter of the rule type with the specified name, nil if there is no such parameter.
+func (rt *RuleType) Param(name string) *RuleParam {
+	for _, rp := range rt.Params {
+		if rp.Name == name {
+			return rp
+		}
+	}
+	return nil
+}
+
+// RuleTypes is the slice of all alert rule types.
+var RuleTypes = []*RuleType{
+	&RuleType{RuleHijack, "Car hijack",
+		"Email alert will be sent if the car device goes dark (no reports for the specified time), or if it is moving but not together with the personal mobile device.",
+		"Car GPS Device", false, []*RuleParam{
+			&RuleParam{Name: "persMob", Label: "Personal Mobile GPS Device", Desc: "Optional. Email alert will be sent if Car GPS device is moving but not together with this device.",
+				Kind: ParamDevice, Optional: true},
+			&RuleParam{Name: "darkMinutes", Label: "Max silence", Desc: "Alert if the car device does not report for longer than this.",
+				Kind: ParamInt, Unit: "min", Def: 5, Min: 1, Max: 24 * 60},
+			&RuleParam{Name: "minMove", Label: "Min movement", Desc: "A device is considered moving if its latest locations are farther from each other than this.",
+				Kind: ParamInt, Unit: "m", Def: 230, Min: 10, Max: 10000},
+			&RuleParam{Name: "margin", Label: "Distance margin", Desc: "Alert if the moving car is farther from the personal mobile device than this.",
+				Kind: ParamInt, Unit: "m", Def: 500, Min: 50, Max: 50000},
+			&RuleParam{Name: "accuracy", Label: "Accuracy correction", Desc: "If both devices are moving, the margin is increased by this for every second elapsed between their latest locations.",
+				Kind: ParamInt, Unit: "m/s", Def: 6, Min: 0, Max: 100},
+		}},
+	&RuleType{RuleDark, "Device gone dark",
+		"Email alert will be sent if the device does not report for longer than the specified time.",
+		"GPS Device", false, []*RuleParam{
+			&RuleParam{Name: "minutes", Label: "Max silence", Desc: "Alert if there are no reports for longer than this.",
+				Kind: ParamInt, Unit: "min", Def: 30, Min: 5, Max: 7 * 24 * 60},
+		}},
+	&RuleType{RuleGeofence, "Geofence",
+		"Email alert will be sent if the device enters or exits the geofence (see the Geofences page).",
+		"GPS Device", true, []*RuleParam{
+			&RuleParam{Name: "geofence", Label: "Geofence", Desc: "The geofence to watch.", Kind: ParamGeofence},
+			&RuleParam{Name: "trigger", Label: "Trigger", Desc: "Which boundary crossings to alert on.",
+				Kind: ParamChoice, Def: TriggerBoth, Choices: []Choice{{TriggerEnter, "Enter"}, {TriggerExit, "Exit"}, {TriggerBoth, "Enter or exit"}}},
+		}},
+	&RuleType{RuleSpeed, "Speeding",
+		"Email alert will be sent if the device exceeds the speed limit for longer than the specified time. The alert is resolved when the speed drops back below the limit.",
+		"GPS Device", false, []*RuleParam{
+			&RuleParam{Name: "limit", Label: "Speed limit", Desc: "Speed reported by the device, or calculated from consecutive track records.",
+				Kind: ParamInt, Unit: "km/h", Def: 90, Min: 10, Max: 500},
+			&RuleParam{Name: "seconds", Label: "Sustained for", Desc: "Alert if the limit is exceeded for at least this long.",
+				Kind: ParamInt, Unit: "s", Def: 60, Min: 0, Max: 3600},
+		}},
+}
+
+// RuleTypeMap maps from rule type name to rule type.
+var RuleTypeMap = make(map[string]*RuleType)
+
+func init() {
+	for _, rt := range RuleTypes {
+		RuleTypeMap[rt.Name] = rt
+	}
+}
+
+// GetType returns the rule type name of the Alert.
+// Alerts created before rule types were introduced have no type, they are of RuleHijack type.
+func (a *Alert) GetType() string {
+	if a.Type == "" {
+		return RuleHijack
+	}
+	return a.Type
+}
+
+// RuleType returns the rule type of the Alert, nil if the type is unknown.
+func (a *Alert) RuleType() *RuleType {
+	return RuleTypeMap[a.GetType()]
+}
+
+// ParamValues returns the parameter values of the Alert, decoded from Params.
+// Defaults are returned for parameters not stored, and for all parameters if Params is malformed (see ParamsError()).
+func (a *Alert) ParamValues() map[string]int64 {
+	values := make(map[string]int64)
+	if a.Params != "" {
+		if err := json.Unmarshal([]byte(a.Params), &values); err != nil {
+			values = make(map[string]int64)
+		}
+	} else if a.Type == "" && a.PersMobDevID != 0 {
+		// Alert created before rule types
+		values["persMob"] = a.PersMobDevID
+	}
+
+	if rt := a.RuleType(); rt != nil {
+		for _, rp := range rt.Params {
+			if _, ok := values[rp.Name]; !ok {
+				values[rp.Name] = rp.Def
+			}
+		}
+	}
+	return values
+}
+
+// ParamsError returns the error decoding Params, nil if it is valid (or empty).
+// Params are only written by SetParamValues(), but a malformed entity must not break the alert check.
+func (a *Alert) ParamsError() error {
+	if a.Params == "" {
+		return nil
+	}
+	var values map[string]int64
+	return json.Unmarshal([]byte(a.Params), &values)
+}
+
+// Param returns the value of the parameter of the Alert with the specified name (see ParamValues()).
+func (a *Alert) Param(name string) int64 {
+	return a.ParamValues()[name]
+}
+
+// SetParamValues sets the parameter values of the Alert, encoded into Params.
+func (a *Alert) SetParamValues(values map[string]int64) {
+	b, err := json.Marshal(values) // This can't really fail...
+	if err != nil {
+		panic(err)
+	}
+	a.Params = string(b)
+}
@@ -0,0 +1,138 @@
+/*
+Defines the Schedule type: weekly time windows, e.g. when an alert is active.
+*/
+
+package ds
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a weekly time window: a time range on the specified days of the week.
+type Window struct {
+	// Days of the window, indexed by time.Weekday
+	Days [7]bool
+
+	// Start and end of the window in minutes of the day.
+	// If End <= Start, the window ends on the next day.
+	Start, End int
+}
+
+// Schedule is a set of weekly time windows, see ParseSchedule().
+type Schedule []Window
+
+// Abbreviated names of the days of the week, indexed by time.Weekday.
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses a schedule from its text format: windows separated by semicolons,
+// each window in the format of "[days] HH:MM-HH:MM", where days is a comma separated list of days
+// and day ranges (e.g. "Mon-Fri,Sun"), every day if omitted. The end of a window may be "24:00",
+// and windows with an end not after the start end on the next day (e.g. "Mon-Fri 20:00-06:00").
+// Blank input is an empty schedule, non-blank input must have at least one window.
+func ParseSchedule(s string) (Schedule, error) {
+	var sc Schedule
+	for _, ws := range strings.Split(s, ";") {
+		fields := strings.Fields(ws)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid window: %q", ws)
+		}
+
+		var w Window
+		if len(fields) == 1 {
+			for i := range w.Days {
+				w.Days[i] = true
+			}
+		} else if err := parseDays(fields[0], &w.Days); err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(fields[len(fields)-1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range: %q", fields[len(fields)-1])
+		}
+		var err error
+		if w.Start, err = parseClock(times[0]); err != nil || w.Start == 24*60 {
+			return nil, fmt.Errorf("invalid time: %q", times[0])
+		}
+		if w.End, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		sc = append(sc, w)
+	}
+	if len(sc) == 0 && strings.TrimSpace(s) != "" {
+		return nil, fmt.Errorf("no windows: %q", s)
+	}
+	return sc, nil
+}
+
+// parseDays parses a comma separated list of days and day ranges (e.g. "Mon-Fri,Sun") into days.
+// Ranges may wrap around the end of the week (e.g. "Sat-Mon").
+func parseDays(s string, days *[7]bool) error {
+	day := func(name string) (int, error) {
+		name = strings.ToLower(name)
+		for i, dn := range dayNames {
+			if name == dn {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day: %q", name)
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		names := strings.Split(part, "-")
+		if len(names) > 2 {
+			return fmt.Errorf("invalid day range: %q", part)
+		}
+		first, err := day(names[0])
+		if err != nil {
+			return err
+		}
+		last := first
+		if len(names) == 2 {
+			if last, err = day(names[1]); err != nil {
+				return err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses a time of the day in "HH:MM" format (00:00..24:00), and returns it in minutes.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || err != nil || len(s) != 5 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains tells if the specified time is inside any of the windows of the schedule.
+// The weekday and time of the day are taken in the location of t.
+func (sc Schedule) Contains(t time.Time) bool {
+	day, m := t.Weekday(), t.Hour()*60+t.Minute()
+	prev := (day + 6) % 7
+	for _, w := range sc {
+		if w.End > w.Start {
+			if w.Days[day] && m >= w.Start && m < w.End {
+				return true
+			}
+			continue
+		}
+		// Window ends on the next day
+		if w.Days[day] && m >= w.Start || w.Days[prev] && m < w.End {
+			return true
+		}
+	}
+	return false
+}
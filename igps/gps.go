@@ -10,6 +10,7 @@ import (
 	"igps/cache"
 	"igps/ds"
 	"igps/page/logic"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
@@ -19,8 +20,11 @@ func init() {
 	http.HandleFunc("/gps", gpsHandler)
 }
 
+// Max valid value of the speed parameter in m/s.
+const maxSpeed = 1000
+
 // gpsHandler is the handler of the requests originating from (GPS) clients
-// reporting GPS coordinates, start/stop events.
+// reporting GPS coordinates (optionally with the speed), start/stop events.
 func gpsHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
@@ -81,6 +85,14 @@ func gpsHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid geopoint specified by latitude (lat) and longitude (lon) parameters (valid range: [-90, 90] latitude and [-180, 180] longitude)!", http.StatusBadRequest)
 			return
 		}
+		// Optional speed in m/s, stored in km/h. Invalid speeds (e.g. -1 for unknown) are ignored, the record is kept.
+		if spd := r.FormValue("spd"); spd != "" {
+			if v, err := strconv.ParseFloat(spd, 64); err != nil || math.IsNaN(v) || v < 0 || v > maxSpeed {
+				c.Warningf("Invalid speed (spd) parameter ignored: %s", spd)
+			} else {
+				gps.Speed, gps.HasSpeed = v*3.6, true
+			}
+		}
 	}
 
 	var dev *ds.Device
@@ -0,0 +1,136 @@
+/*
+Google Maps map provider.
+
+Static maps documentation: https://developers.google.com/maps/documentation/staticmaps/
+Embed API documentation: https://developers.google.com/maps/documentation/embed/
+*/
+
+package maps
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// googleProvider is the Google Maps map provider.
+type googleProvider struct {
+	// API key of the Google Maps APIs
+	key string
+}
+
+// Name implements Provider.Name().
+func (g *googleProvider) Name() string {
+	return NameGoogle
+}
+
+// StaticMapURL implements Provider.StaticMapURL().
+//
+// Paths are written in encoded polyline format. Small markers of the same color are grouped
+// into one markers parameter to keep the URL short.
+func (g *googleProvider) StaticMapURL(m *StaticMap) string {
+	// Returned string will be around a few KB, allocated reasonable buffer:
+	b := bytes.NewBuffer(make([]byte, 0, 2048))
+
+	fmt.Fprintf(b, "https://maps.googleapis.com/maps/api/staticmap?size=%dx%d", m.Width, m.Height)
+	if m.Format != "" {
+		b.WriteString("&format=" + url.QueryEscape(m.Format))
+	}
+	if m.MapType != "" {
+		b.WriteString("&maptype=" + url.QueryEscape(m.MapType))
+	}
+	if m.Center != "" {
+		b.WriteString("&center=" + url.QueryEscape(m.Center))
+	}
+	if m.Zoom > 0 {
+		fmt.Fprintf(b, "&zoom=%d", m.Zoom)
+	}
+	if g.key != "" {
+		b.WriteString("&key=" + url.QueryEscape(g.key))
+	}
+
+	// PATHS
+
+	for _, path := range m.Paths {
+		b.WriteString("&path=")
+		if path.Color != "" {
+			b.WriteString("color:" + googleColor(path.Color) + "c0|")
+		}
+		b.WriteString("enc:")
+		b.WriteString(url.QueryEscape(EncodePolyline(path.Points)))
+	}
+
+	// MARKERS
+
+	var smallClrs []string              // Colors of small markers in order of first occurrence
+	smalls := make(map[string][]string) // Locations of small markers grouped by color
+	for _, mk := range m.Markers {
+		if mk.Small {
+			if _, ok := smalls[mk.Color]; !ok {
+				smallClrs = append(smallClrs, mk.Color)
+			}
+			smalls[mk.Color] = append(smalls[mk.Color], fmt.Sprintf("%.5f,%.5f", mk.Lat, mk.Lng))
+			continue
+		}
+		b.WriteString("&markers=")
+		if mk.Color != "" {
+			b.WriteString("color:" + googleColor(mk.Color) + "|")
+		}
+		if mk.Label != 0 {
+			fmt.Fprintf(b, "label:%c|", mk.Label)
+		}
+		fmt.Fprintf(b, "%f,%f", mk.Lat, mk.Lng)
+	}
+	for _, clr := range smallClrs {
+		fmt.Fprintf(b, "&markers=color:%s|size:small|%s", googleColor(clr), strings.Join(smalls[clr], "|"))
+	}
+
+	return b.String()
+}
+
+// googleColor returns the specified color in the format of the Static Maps API:
+// colors in "#rrggbb" format are converted to "0xrrggbb", color names are returned as-is.
+func googleColor(color string) string {
+	if strings.HasPrefix(color, "#") {
+		return "0x" + color[1:]
+	}
+	return color
+}
+
+// EmbeddedMapURL implements Provider.EmbeddedMapURL().
+func (g *googleProvider) EmbeddedMapURL(center string, zoom int, mapType string) string {
+	u := "https://www.google.com/maps/embed/v1/place?q=" + url.QueryEscape(center) + "&key=" + url.QueryEscape(g.key)
+	if zoom > 0 {
+		u += fmt.Sprintf("&zoom=%d", zoom)
+	}
+	// The Embed API only supports the roadmap and satellite map types
+	if mapType == MapTypeSatellite || mapType == MapTypeHybrid {
+		u += "&maptype=" + MapTypeSatellite
+	}
+	return u
+}
+
+// ViewURL implements Provider.ViewURL().
+func (g *googleProvider) ViewURL(center string, zoom int) string {
+	u := "https://www.google.com/maps?q=" + url.QueryEscape(center)
+	if zoom > 0 {
+		u += fmt.Sprintf("&z=%d", zoom)
+	}
+	return u
+}
+
+// JSAPIKey implements Provider.JSAPIKey().
+func (g *googleProvider) JSAPIKey() string {
+	return g.key
+}
+
+// TileURL implements Provider.TileURL().
+func (g *googleProvider) TileURL() string {
+	return ""
+}
+
+// Attribution implements Provider.Attribution().
+func (g *googleProvider) Attribution() string {
+	return ""
+}
@@ -0,0 +1,166 @@
+/*
+Package maps provides the map provider abstraction: map providers build the URLs of
+static map images, embeddable maps and map pages to view locations.
+
+The provider and its settings are chosen in the app configuration (env_variables in app.yaml):
+
+	MAP_PROVIDER          Name of the provider: "google" (default), "osm" or "tiles"
+	MAP_API_KEY           API key of the Google Maps APIs (used by the "google" provider)
+	MAP_TILE_URL          Tile URL template with {z}, {x} and {y} placeholders (used by the "tiles" provider)
+	MAP_TILE_ATTRIBUTION  Attribution (HTML) displayed on maps rendered from tiles
+	MAP_STATIC_URL        URL of an OpenStreetMap-based static map server (staticmap.php compatible)
+*/
+package maps
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Names of the environment variables of the configuration.
+const (
+	envProvider    = "MAP_PROVIDER"
+	envAPIKey      = "MAP_API_KEY"
+	envTileURL     = "MAP_TILE_URL"
+	envAttribution = "MAP_TILE_ATTRIBUTION"
+	envStaticURL   = "MAP_STATIC_URL"
+)
+
+// Names of the map providers.
+const (
+	// Google Maps APIs
+	NameGoogle = "google"
+
+	// OpenStreetMap tiles and an OpenStreetMap-based static map server
+	NameOSM = "osm"
+
+	// Self-hosted tile server
+	NameTiles = "tiles"
+)
+
+// Path of the page displaying an interactive map rendered from tiles (see the EmbedMap page).
+// Used as the embedded map and view URL of tile based providers.
+const EmbedPagePath = "/embedmap"
+
+// Map types. Providers not supporting map types display the default (road) map.
+const (
+	MapTypeRoadmap   = "roadmap"
+	MapTypeSatellite = "satellite"
+	MapTypeTerrain   = "terrain"
+	MapTypeHybrid    = "hybrid"
+)
+
+// Valid map types.
+var MapTypes = []string{MapTypeRoadmap, MapTypeSatellite, MapTypeTerrain, MapTypeHybrid}
+
+// LatLng is a geographical location.
+type LatLng struct {
+	Lat, Lng float64
+}
+
+// Marker is a marker on a static map.
+type Marker struct {
+	LatLng
+
+	// Color of the marker, a color name (e.g. "blue" or "green") or in "#rrggbb" format
+	Color string
+
+	// Label of the marker, 0 if none. Providers not supporting labels ignore it.
+	Label rune
+
+	// Tells if the marker is to be displayed small (without label)
+	Small bool
+}
+
+// StaticMap describes a static map image.
+type StaticMap struct {
+	// Size of the image in pixels
+	Width, Height int
+
+	// Image format, empty for the default of the provider (png)
+	Format string
+
+	// Map type, one of MapTypes, empty for roadmap
+	MapType string
+
+	// Center of the map in "lat,lng" format (see Center()).
+	// Empty means the map is fitted to the markers and paths.
+	Center string
+
+	// Zoom level, 0 means the map is fitted to the markers and paths
+	Zoom int
+
+	// Markers to display
+	Markers []Marker
+
+	// Paths to display. Providers not supporting paths ignore them.
+	Paths []Path
+}
+
+// Path is a path on a static map.
+type Path struct {
+	// Color of the path in "#rrggbb" format, empty for the default color of the provider
+	Color string
+
+	// Locations of the path
+	Points []LatLng
+}
+
+// Provider is a map provider.
+type Provider interface {
+	// Name returns the name of the provider.
+	Name() string
+
+	// StaticMapURL returns the URL of the specified static map image.
+	// Returns an empty string if the provider does not support static maps.
+	StaticMapURL(m *StaticMap) string
+
+	// EmbeddedMapURL returns the URL of an interactive map to be embedded in an <iframe>,
+	// centered at the specified location ("lat,lng" format, see Center()).
+	EmbeddedMapURL(center string, zoom int, mapType string) string
+
+	// ViewURL returns the URL of a map page showing the specified location ("lat,lng" format, see Center()),
+	// to be opened on a new tab.
+	ViewURL(center string, zoom int) string
+
+	// JSAPIKey returns the API key of the Google Maps JavaScript API.
+	// Returns an empty string if the provider does not support the Google Maps JavaScript API.
+	JSAPIKey() string
+
+	// TileURL returns the tile URL template with {z}, {x} and {y} placeholders.
+	// Returns an empty string if the provider does not serve tiles.
+	TileURL() string
+
+	// Attribution returns the attribution (HTML) to be displayed on maps rendered from tiles.
+	Attribution() string
+}
+
+var (
+	// The configured map provider
+	current Provider
+
+	// Used to load the configuration only once, on first use
+	currentOnce sync.Once
+)
+
+// Current returns the map provider chosen in the app configuration.
+// The Google provider is returned if the configured provider is unknown.
+func Current() Provider {
+	currentOnce.Do(func() {
+		switch os.Getenv(envProvider) {
+		case NameOSM:
+			current = newOSMProvider(os.Getenv(envStaticURL))
+		case NameTiles:
+			current = newTileProvider(os.Getenv(envTileURL), os.Getenv(envAttribution), os.Getenv(envStaticURL))
+		default:
+			current = &googleProvider{key: os.Getenv(envAPIKey)}
+		}
+	})
+	return current
+}
+
+// Center formats the specified location in "lat,lng" format to be used as the center of maps.
+func Center(lat, lng float64) string {
+	return fmt.Sprintf("%f,%f", lat, lng)
+}
@@ -0,0 +1,38 @@
+/*
+Encoded polyline algorithm format: https://developers.google.com/maps/documentation/utilities/polylinealgorithm
+*/
+
+package maps
+
+import (
+	"bytes"
+	"math"
+)
+
+// EncodePolyline returns the specified locations in encoded polyline format.
+func EncodePolyline(path []LatLng) string {
+	b := bytes.NewBuffer(make([]byte, 0, len(path)*8))
+
+	var plat, plng int64
+	for _, ll := range path {
+		lat, lng := int64(math.Floor(ll.Lat*1e5+0.5)), int64(math.Floor(ll.Lng*1e5+0.5))
+		encodePolylineValue(b, lat-plat)
+		encodePolylineValue(b, lng-plng)
+		plat, plng = lat, lng
+	}
+
+	return b.String()
+}
+
+// encodePolylineValue writes the specified (delta) value in encoded polyline format.
+func encodePolylineValue(b *bytes.Buffer, v int64) {
+	v <<= 1
+	if v < 0 {
+		v = ^v
+	}
+	for v >= 0x20 {
+		b.WriteByte(byte(0x20|v&0x1f) + 63)
+		v >>= 5
+	}
+	b.WriteByte(byte(v) + 63)
+}
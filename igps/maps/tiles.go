@@ -0,0 +1,184 @@
+/*
+Tile based map providers: OpenStreetMap and self-hosted tile servers.
+
+Interactive maps are rendered from tiles by the EmbedMap page (see EmbedPagePath).
+Static maps are served by an OpenStreetMap-based static map server if one is configured,
+its API is that of staticmap.php: http://staticmap.openstreetmap.de/
+*/
+
+package maps
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+)
+
+// Defaults of the OpenStreetMap provider.
+const (
+	osmTileURL     = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	osmAttribution = `&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a> contributors`
+	osmStaticURL   = "https://staticmap.openstreetmap.de/staticmap.php"
+)
+
+// Max zoom level static maps are fitted with, also used if there is a single location.
+const maxFitZoom = 17
+
+// Padding in pixels kept around markers and paths when fitting static maps.
+const fitPadding = 20
+
+// tileProvider is a tile based map provider.
+type tileProvider struct {
+	// Name of the provider
+	name string
+
+	// Tile URL template with {z}, {x} and {y} placeholders
+	tileURL string
+
+	// Attribution to be displayed on maps
+	attribution string
+
+	// URL of the static map server, empty if static maps are not supported
+	staticURL string
+}
+
+// newOSMProvider creates the OpenStreetMap provider.
+// If staticURL is empty, the default OpenStreetMap static map server is used.
+func newOSMProvider(staticURL string) *tileProvider {
+	if staticURL == "" {
+		staticURL = osmStaticURL
+	}
+	return &tileProvider{name: NameOSM, tileURL: osmTileURL, attribution: osmAttribution, staticURL: staticURL}
+}
+
+// newTileProvider creates a provider of a self-hosted tile server.
+// OpenStreetMap tiles are used if tileURL is empty.
+// Static maps are not supported if staticURL is empty.
+func newTileProvider(tileURL, attribution, staticURL string) *tileProvider {
+	if tileURL == "" {
+		tileURL, attribution = osmTileURL, osmAttribution
+	}
+	return &tileProvider{name: NameTiles, tileURL: tileURL, attribution: attribution, staticURL: staticURL}
+}
+
+// Name implements Provider.Name().
+func (t *tileProvider) Name() string {
+	return t.name
+}
+
+// StaticMapURL implements Provider.StaticMapURL().
+//
+// Paths and marker labels are not supported by the static map server, they are ignored.
+func (t *tileProvider) StaticMapURL(m *StaticMap) string {
+	if t.staticURL == "" {
+		return ""
+	}
+
+	// The static map server requires center and zoom
+	center, zoom := m.Center, m.Zoom
+	if center == "" || zoom <= 0 {
+		fc, fz := fit(m)
+		if center == "" {
+			center = fc
+		}
+		if zoom <= 0 {
+			zoom = fz
+		}
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, 1024))
+	fmt.Fprintf(b, "%s?center=%s&zoom=%d&size=%dx%d&maptype=mapnik", t.staticURL, url.QueryEscape(center), zoom, m.Width, m.Height)
+	for i, mk := range m.Markers {
+		if i == 0 {
+			b.WriteString("&markers=")
+		} else {
+			b.WriteString("%7C")
+		}
+		fmt.Fprintf(b, "%.5f,%.5f,%s", mk.Lat, mk.Lng, markerIcon(mk.Color))
+	}
+
+	return b.String()
+}
+
+// markerIcon returns the name of the marker icon of the static map server for the specified color.
+// The server has a few marker colors only, other colors (e.g. "#rrggbb" colors) are displayed gold.
+func markerIcon(color string) string {
+	switch color {
+	case "blue", "green", "gold":
+		return "ol-marker-" + color
+	case "red":
+		return "ol-marker"
+	}
+	return "ol-marker-gold"
+}
+
+// fit returns the center and the zoom level which fit the markers and paths of the specified static map.
+// Zoom levels are calculated with the Web Mercator projection used by tiles.
+func fit(m *StaticMap) (center string, zoom int) {
+	minLat, maxLat, minLng, maxLng := 90.0, -90.0, 180.0, -180.0
+	extend := func(ll LatLng) {
+		minLat, maxLat = math.Min(minLat, ll.Lat), math.Max(maxLat, ll.Lat)
+		minLng, maxLng = math.Min(minLng, ll.Lng), math.Max(maxLng, ll.Lng)
+	}
+	for _, mk := range m.Markers {
+		extend(mk.LatLng)
+	}
+	for _, path := range m.Paths {
+		for _, ll := range path.Points {
+			extend(ll)
+		}
+	}
+	if minLat > maxLat {
+		// Nothing to fit, whole world
+		return Center(0, 0), 1
+	}
+
+	center = Center((minLat+maxLat)/2, (minLng+maxLng)/2)
+
+	// Size of the bounds in pixels at zoom level 0 (256 pixels wide world):
+	mercY := func(lat float64) float64 {
+		r := lat * math.Pi / 180
+		return math.Log(math.Tan(r)+1/math.Cos(r)) / math.Pi * 128
+	}
+	dx, dy := (maxLng-minLng)/360*256, mercY(maxLat)-mercY(minLat)
+
+	zoom = maxFitZoom
+	w, h := float64(m.Width-2*fitPadding), float64(m.Height-2*fitPadding)
+	for ; zoom > 1; zoom-- {
+		scale := math.Pow(2, float64(zoom))
+		if dx*scale <= w && dy*scale <= h {
+			break
+		}
+	}
+	return
+}
+
+// EmbeddedMapURL implements Provider.EmbeddedMapURL().
+func (t *tileProvider) EmbeddedMapURL(center string, zoom int, mapType string) string {
+	u := EmbedPagePath + "?center=" + url.QueryEscape(center)
+	if zoom > 0 {
+		u += fmt.Sprintf("&zoom=%d", zoom)
+	}
+	return u
+}
+
+// ViewURL implements Provider.ViewURL().
+func (t *tileProvider) ViewURL(center string, zoom int) string {
+	return t.EmbeddedMapURL(center, zoom, "")
+}
+
+// JSAPIKey implements Provider.JSAPIKey().
+func (t *tileProvider) JSAPIKey() string {
+	return ""
+}
+
+// TileURL implements Provider.TileURL().
+func (t *tileProvider) TileURL() string {
+	return t.tileURL
+}
+
+// Attribution implements Provider.Attribution().
+func (t *tileProvider) Attribution() string {
+	return t.attribution
+}
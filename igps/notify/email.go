@@ -0,0 +1,33 @@
+/*
+Email notifier.
+*/
+
+package notify
+
+import (
+	"appengine"
+	"appengine/mail"
+)
+
+// Email is a notifier sending emails.
+type Email struct {
+	// Recipients of the emails
+	To, Cc, Bcc []string
+}
+
+// Notify implements Notifier.Notify().
+func (e *Email) Notify(c appengine.Context, m *Message) error {
+	msg := &mail.Message{
+		Sender:  AdminEmail,
+		To:      e.To,
+		Cc:      e.Cc,
+		Bcc:     e.Bcc,
+		ReplyTo: AdminEmail,
+		Subject: "[IczaGPS] " + m.Subject,
+		Body:    m.Body,
+	}
+	for _, a := range m.Attachments {
+		msg.Attachments = append(msg.Attachments, mail.Attachment{Name: a.Name, Data: a.Data})
+	}
+	return mail.Send(c, msg)
+}
@@ -0,0 +1,115 @@
+/*
+HTTP gateway notifier: SMS and chat messages sent through a configurable HTTP gateway
+(e.g. an SMS provider or a chat bot API).
+*/
+
+package notify
+
+import (
+	"appengine"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Placeholders of the gateway templates.
+const (
+	// Recipient (phone number or chat ID)
+	PlaceholderTo = "{to}"
+
+	// Text of the message
+	PlaceholderText = "{text}"
+)
+
+// Max lengths of gateway messages (in characters).
+const (
+	SMSMaxLen  = 160
+	ChatMaxLen = 1000
+)
+
+// Gateway is a notifier sending short text messages through an HTTP gateway, one request per recipient.
+//
+// The placeholders (PlaceholderXXX) are substituted in the URL template (URL query escaped) and in
+// the body template. Body templates starting with '{' or '[' are JSON: placeholders are substituted
+// JSON escaped (inside string literals), and the Content-Type is "application/json".
+// Other body templates are form encoded (placeholders are URL query escaped). If the body template is
+// empty, a GET request is sent, else a POST request.
+// Failed deliveries are retried with backoff (see deliver()).
+type Gateway struct {
+	// URL template
+	URLTemplate string
+
+	// Optional authentication (or any other) HTTP header in "Name: value" format
+	AuthHeader string
+
+	// Body template
+	BodyTemplate string
+
+	// Recipients: phone numbers or chat IDs
+	Recipients []string
+
+	// Max length of the messages
+	MaxLen int
+}
+
+// Notify implements Notifier.Notify().
+func (g *Gateway) Notify(c appengine.Context, m *Message) error {
+	text := ShortText(m, g.MaxLen)
+
+	isJSON := strings.HasPrefix(g.BodyTemplate, "{") || strings.HasPrefix(g.BodyTemplate, "[")
+	var errs []string
+	for _, to := range g.Recipients {
+		hr := &httpRequest{Method: "GET", URL: substitute(g.URLTemplate, to, text, url.QueryEscape)}
+		if g.AuthHeader != "" {
+			hr.Headers = append(hr.Headers, g.AuthHeader)
+		}
+		if g.BodyTemplate != "" {
+			hr.Method = "POST"
+			if isJSON {
+				hr.Body = []byte(substitute(g.BodyTemplate, to, text, jsonEscape))
+				hr.Headers = append(hr.Headers, "Content-Type: application/json")
+			} else {
+				hr.Body = []byte(substitute(g.BodyTemplate, to, text, url.QueryEscape))
+				hr.Headers = append(hr.Headers, "Content-Type: application/x-www-form-urlencoded")
+			}
+		}
+		if err := deliver(c, hr, m); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", to, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send to recipients: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// substitute substitutes the placeholders in the specified template with the escaped recipient and text.
+func substitute(templ, to, text string, escape func(string) string) string {
+	return strings.NewReplacer(PlaceholderTo, escape(to), PlaceholderText, escape(text)).Replace(templ)
+}
+
+// jsonEscape escapes the specified string to be used inside a JSON string literal.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s) // This can't really fail
+	return string(b[1 : len(b)-1])
+}
+
+// ShortText returns the short text format of the specified message, at most maxLen characters long:
+// the subject, followed by the latest position of the device for alert notifications.
+func ShortText(m *Message, maxLen int) string {
+	text := "IczaGPS " + m.Subject
+	if m.Event != nil && m.Event.Position != nil {
+		pos := m.Event.Position
+		text += fmt.Sprintf(" @%.5f,%.5f %s", pos.Lat, pos.Lng, pos.Time.UTC().Format("15:04 MST"))
+	}
+
+	if utf8.RuneCountInString(text) <= maxLen {
+		return text
+	}
+	const ellipsis = "..."
+	runes := []rune(text)
+	return string(runes[:maxLen-len(ellipsis)]) + ellipsis
+}
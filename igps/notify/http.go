@@ -0,0 +1,160 @@
+/*
+Delivery of notifications over HTTP (used by the webhook and gateway notifiers).
+
+Requests are delivered by push tasks (see deliverHandler()), failed deliveries are retried
+by the task queue with exponential backoff. The results of the deliveries are recorded
+in the notification log entries of the messages (see Message.LogKey).
+*/
+
+package notify
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"bytes"
+	"fmt"
+	"igps/ds"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc(deliverTaskPath, deliverHandler)
+}
+
+// Path of the delivery task handler.
+const deliverTaskPath = "/task/deliver"
+
+// Retry options of deliveries: retried with exponential backoff for about a day
+// (the backoff reaches the hour after 9 retries).
+// A retry limit is used (and not an age limit) so the handler can tell the last attempt.
+var deliverRetryOptions = &taskqueue.RetryOptions{
+	MinBackoff: 10 * time.Second,
+	MaxBackoff: time.Hour,
+	RetryLimit: 32,
+}
+
+// httpRequest is an HTTP request delivering a notification.
+type httpRequest struct {
+	// HTTP method and URL
+	Method, URL string
+
+	// HTTP headers in "Name: value" format
+	Headers []string
+
+	// Body of the request, nil if none
+	Body []byte
+}
+
+// deliver delivers the specified request of the specified message. Requests of test messages
+// are delivered immediately without retries, others are queued for delivery.
+func deliver(c appengine.Context, hr *httpRequest, m *Message) error {
+	if m.Test {
+		return hr.do(c)
+	}
+
+	params := url.Values{
+		"method": {hr.Method},
+		"url":    {hr.URL},
+		"header": hr.Headers,
+		"body":   {string(hr.Body)},
+	}
+	if m.LogKey != nil {
+		params.Set("log", m.LogKey.Encode())
+	}
+	t := taskqueue.NewPOSTTask(deliverTaskPath, params)
+	t.RetryOptions = deliverRetryOptions
+	_, err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// deliverHandler is the handler of the delivery tasks: performs the request, and records the result
+// in the notification log entry (if any, see logDelivery()).
+// Responds with an error status code if the delivery fails, so the task is retried.
+func deliverHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	// This header can't be set by external requests
+	if r.Header.Get("X-AppEngine-TaskName") == "" {
+		c.Warningf("Not a task request!")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	hr := &httpRequest{Method: r.FormValue("method"), URL: r.FormValue("url"), Headers: r.Form["header"]}
+	if body := r.FormValue("body"); body != "" {
+		hr.Body = []byte(body)
+	}
+	err := hr.do(c)
+	retries, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+	if logKey := r.FormValue("log"); logKey != "" {
+		logDelivery(c, logKey, err, retries >= int(deliverRetryOptions.RetryLimit))
+	}
+	if err != nil {
+		c.Errorf("Delivery failed (retry count: %d): %v", retries, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	c.Infof("Delivered: %s %s", hr.Method, hr.URL)
+}
+
+// logDelivery records the result of a delivery attempt in the notification log entry (ds.Notification)
+// with the specified encoded key. The entry stays pending after failed attempts, unless it was the last one.
+func logDelivery(c appengine.Context, logKey string, result error, last bool) {
+	key, err := datastore.DecodeKey(logKey)
+	if err != nil {
+		c.Errorf("Invalid notification log key: %v", err)
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		n := new(ds.Notification)
+		if err := datastore.Get(tc, key, n); err != nil {
+			return err
+		}
+		n.Success, n.Pending, n.Error = result == nil, result != nil && !last, ""
+		if result != nil {
+			n.Error = result.Error()
+		}
+		_, err := datastore.Put(tc, key, n)
+		return err
+	}, nil)
+	if err != nil {
+		// ErrNoSuchEntity if the entry is already deleted (see the alert history retention)
+		c.Warningf("Failed to update notification log entry: %v", err)
+	}
+}
+
+// do performs the request. Returns an error if the response status is not 2xx.
+func (hr *httpRequest) do(c appengine.Context) error {
+	var body io.Reader
+	if hr.Body != nil {
+		body = bytes.NewReader(hr.Body)
+	}
+	req, err := http.NewRequest(hr.Method, hr.URL, body)
+	if err != nil {
+		return err
+	}
+	for _, h := range hr.Headers {
+		if i := strings.Index(h, ":"); i > 0 {
+			req.Header.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+		}
+	}
+
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("response status: %s", resp.Status)
+	}
+	return nil
+}
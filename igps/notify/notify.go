@@ -0,0 +1,136 @@
+/*
+Package notify provides the notification channel abstraction: notifiers deliver
+messages (e.g. alert notifications) to the users over different channels.
+
+Implementations are email (Email), HTTP webhook (Webhook) and HTTP gateway (Gateway, for SMS and chat messages) notifiers.
+*/
+package notify
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"igps/ds"
+	"strings"
+	"time"
+)
+
+// Sender and reply-to address of the emails.
+const AdminEmail = "Andras Belicza <iczaaa@gmail.com>"
+
+// Notifier is the interface of notification channels.
+type Notifier interface {
+	// Notify delivers the specified message.
+	// A nil error means the message is sent or is queued for delivery.
+	Notify(c appengine.Context, m *Message) error
+}
+
+// ForAccount returns the notifier of the emails of the specified account (ds.ChannelAccountEmail):
+// the email of the account, and the contact email (if any).
+func ForAccount(acc *ds.Account) Notifier {
+	e := &Email{To: []string{acc.Email}}
+	if len(acc.ContactEmail) > 0 {
+		e.Cc = []string{acc.ContactEmail}
+	}
+	return e
+}
+
+// ForChannel returns the notifier of the specified channel, nil if the channel type is unknown.
+func ForChannel(ch *ds.Channel) Notifier {
+	switch ch.Type {
+	case ds.ChannelEmail:
+		e := &Email{}
+		for _, addr := range strings.Split(ch.Target, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				e.To = append(e.To, addr)
+			}
+		}
+		return e
+	case ds.ChannelWebhook:
+		return &Webhook{URL: ch.Target, Secret: ch.Secret}
+	case ds.ChannelSMS, ds.ChannelChat:
+		g := &Gateway{URLTemplate: ch.Target, AuthHeader: ch.AuthHeader, BodyTemplate: ch.BodyTemplate, Recipients: ch.Recipients, MaxLen: SMSMaxLen}
+		if ch.Type == ds.ChannelChat {
+			g.MaxLen = ChatMaxLen
+		}
+		return g
+	}
+	return nil
+}
+
+// Message is a notification message.
+type Message struct {
+	// Subject of the message
+	Subject string
+
+	// Body of the message (plain text)
+	Body string
+
+	// Attachments of the message (channels may ignore them)
+	Attachments []Attachment
+
+	// Structured data of alert notifications for machine consumers (e.g. webhooks), nil for other messages
+	Event *Event
+
+	// Tells if this is a test message: it is delivered immediately without retries,
+	// and delivery errors are returned by Notify()
+	Test bool
+
+	// Key of the notification log entry (ds.Notification) of the message, nil if none.
+	// Queued deliveries record their result in it (see deliverHandler()).
+	LogKey *datastore.Key
+}
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	// File name
+	Name string
+
+	// Content of the file
+	Data []byte
+}
+
+// Kinds of alert notifications.
+const (
+	// The alert started firing (or an event occurred)
+	KindAlert = "alert"
+
+	// The alert is still firing
+	KindReminder = "reminder"
+
+	// The alert is resolved
+	KindResolved = "resolved"
+)
+
+// Event describes an alert notification.
+type Event struct {
+	// Kind of the notification, one of KindXXX
+	Kind string `json:"kind"`
+
+	// Key ID of the alert
+	AlertID int64 `json:"alertId"`
+
+	// Rule type name of the alert (one of ds.RuleXXX)
+	Type string `json:"type"`
+
+	// Message of the alert
+	Message string `json:"message"`
+
+	// Key ID and name of the monitored device
+	DeviceID int64  `json:"deviceId"`
+	Device   string `json:"device"`
+
+	// Latest known position of the device, nil if unknown
+	Position *Position `json:"position,omitempty"`
+
+	// Time of the notification
+	Time time.Time `json:"time"`
+}
+
+// Position is a reported position of a device.
+type Position struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+
+	// Time of the report
+	Time time.Time `json:"time"`
+}
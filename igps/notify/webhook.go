@@ -0,0 +1,64 @@
+/*
+HTTP webhook notifier.
+*/
+
+package notify
+
+import (
+	"appengine"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Name of the HTTP header carrying the signature of webhook payloads.
+const SignatureHeader = "X-IczaGPS-Signature"
+
+// Webhook is a notifier posting a JSON payload (see WebhookPayload) to an HTTP(S) URL.
+// The payload is signed with HMAC-SHA256 using the shared secret, the hex encoded signature
+// is sent in the SignatureHeader header in the format of "sha256=<signature>".
+// Failed deliveries are retried with backoff (see deliver()).
+type Webhook struct {
+	// URL to post the payloads to
+	URL string
+
+	// Shared secret to sign the payloads with
+	Secret string
+}
+
+// WebhookPayload is the JSON payload posted by webhooks.
+type WebhookPayload struct {
+	// Subject and body of the message
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+
+	// Alert notification data, nil if the message is not an alert notification
+	Alert *Event `json:"alert,omitempty"`
+
+	// Time when the message was sent
+	Sent time.Time `json:"sent"`
+}
+
+// Sign returns the signature of the specified payload with the specified secret, in the format of the SignatureHeader.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify implements Notifier.Notify().
+func (wh *Webhook) Notify(c appengine.Context, m *Message) error {
+	payload, err := json.Marshal(&WebhookPayload{Subject: m.Subject, Text: m.Body, Alert: m.Event, Sent: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	return deliver(c, &httpRequest{
+		Method:  "POST",
+		URL:     wh.URL,
+		Headers: []string{"Content-Type: application/json", SignatureHeader + ": " + Sign(wh.Secret, payload)},
+		Body:    payload,
+	}, m)
+}
@@ -0,0 +1,165 @@
+/*
+AlertAck page logic: acknowledging and snoozing alerts via signed, expiring links sent in alert emails,
+without logging in.
+
+Links are signed with HMAC-SHA256 using the secret of the alert (see ds.Alert.Secret), so they are invalidated
+when the alert is deleted.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"igps/ds"
+	"igps/page"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["AlertAck"].Logic = alertAck
+}
+
+// Actions of alert acknowledge links.
+const (
+	// Acknowledge the firing alert: no reminders and resolved notification
+	AckActionMe = "me"
+
+	// Snooze the alert for snoozeDuration
+	AckActionSnooze = "snooze"
+
+	// Snooze the alert until the next midnight in the time zone of the account
+	AckActionTomorrow = "tomorrow"
+)
+
+// ackActionTitles maps from ack action to its title.
+var ackActionTitles = map[string]string{
+	AckActionMe:       "It's me",
+	AckActionSnooze:   "Snooze 2 hours",
+	AckActionTomorrow: "Disable until tomorrow",
+}
+
+// Snooze duration of the AckActionSnooze action.
+const snoozeDuration = 2 * time.Hour
+
+// Validity of alert acknowledge links.
+const AckLinkValidity = 24 * time.Hour
+
+// Base URL of absolute links sent in emails.
+const appURL = "https://iczagps.appspot.com"
+
+// NewAlertSecret generates a new random secret for signing the acknowledge links of an alert.
+func NewAlertSecret() (string, error) {
+	b := make([]byte, 24) // Multiple of 3 bytes (ideal for base64 encoding so no padding '=' signs will be needed)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// alertAckSig returns the signature of an alert acknowledge link.
+func alertAckSig(secret string, accKeyID, alertID int64, action string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d:%d:%s:%d", accKeyID, alertID, action, exp)
+	// First 24 bytes, no padding '=' signs needed
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)[:24])
+}
+
+// AlertAckURL returns the absolute URL of the signed acknowledge link of the specified alert
+// of the account with the specified id, which performs the specified action (one of AckActionXXX) until exp.
+func AlertAckURL(a *ds.Alert, accKeyID int64, action string, exp time.Time) string {
+	v := url.Values{}
+	v.Set("acc", strconv.FormatInt(accKeyID, 10))
+	v.Set("alert", strconv.FormatInt(a.KeyID, 10))
+	v.Set("action", action)
+	v.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	v.Set("sig", alertAckSig(a.Secret, accKeyID, a.KeyID, action, exp.Unix()))
+	return appURL + page.NamePageMap["AlertAck"].Path + "?" + v.Encode()
+}
+
+// alertAck is the logic implementation of the AlertAck page.
+//
+// Form parameters: "acc" and "alert", the key IDs of the account and the alert, "action" (one of AckActionXXX),
+// "exp", the expiration of the link (Unix time in seconds) and "sig", the signature of the link.
+// The action is performed when the confirmation form ("submitConfirm") is submitted, so link prefetchers
+// (e.g. of email clients) do not perform it.
+func alertAck(p *page.Params) {
+	c := p.AppCtx
+	fv := p.Request.FormValue
+
+	accKeyID, err := strconv.ParseInt(fv("acc"), 10, 64)
+	alertID, err2 := strconv.ParseInt(fv("alert"), 10, 64)
+	exp, err3 := strconv.ParseInt(fv("exp"), 10, 64)
+	action := fv("action")
+	if err != nil || err2 != nil || err3 != nil || ackActionTitles[action] == "" {
+		p.ErrorMsg = "Invalid link!"
+		return
+	}
+	if time.Now().Unix() > exp {
+		p.ErrorMsg = SExecTempl("The link has expired! You can manage your Alerts on the {{.}} page after logging in.", page.NamePageMap["Alerts"].Link())
+		return
+	}
+
+	accKey := datastore.NewKey(c, ds.ENameAccount, "", accKeyID, nil)
+	key := datastore.NewKey(c, ds.ENameAlert, "", alertID, accKey)
+	alert := new(ds.Alert)
+	if err := datastore.Get(c, key, alert); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			p.ErrorMsg = "Invalid link! The Alert does not exist (anymore)."
+		} else {
+			p.Err = err // Real datastore error
+		}
+		return
+	}
+	if alert.Secret == "" || !hmac.Equal([]byte(fv("sig")), []byte(alertAckSig(alert.Secret, accKeyID, alertID, action, exp))) {
+		p.ErrorMsg = "Invalid link!"
+		return
+	}
+
+	if p.Request.PostFormValue("submitConfirm") != "" {
+		acc := new(ds.Account)
+		if p.Err = datastore.Get(c, accKey, acc); p.Err != nil {
+			return
+		}
+		now := time.Now()
+		p.Err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			if err := datastore.Get(tc, key, alert); err != nil {
+				return err
+			}
+			switch action {
+			case AckActionMe:
+				alert.AckedAt = now
+			case AckActionSnooze:
+				alert.SnoozedUntil = now.Add(snoozeDuration)
+			case AckActionTomorrow:
+				t := now.In(acc.Location())
+				alert.SnoozedUntil = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			}
+			_, err := datastore.Put(tc, key, alert)
+			return err
+		}, nil)
+		if p.Err != nil {
+			return
+		}
+		switch action {
+		case AckActionMe:
+			p.InfoMsg = "Alert acknowledged. No more reminders will be sent until it is resolved."
+		default:
+			// In the time zone of the account (no user is logged in)
+			p.InfoMsg = "Alert snoozed until " + alert.SnoozedUntil.In(acc.Location()).Format("2006-01-02 15:04 MST") + "."
+		}
+		p.Custom["Done"] = true
+	}
+
+	p.Custom["Alert"] = alert
+	p.Custom["Action"] = action
+	p.Custom["ActionTitle"] = ackActionTitles[action]
+	p.Custom["Firing"] = alert.GetState() == ds.StateFiring
+}
@@ -0,0 +1,183 @@
+/*
+Alert History page logic: the alert evaluations which found alerts firing (or resolved them), and their notification attempts.
+*/
+
+package logic
+
+import (
+	"appengine/datastore"
+	"html/template"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"net/url"
+	"strconv"
+)
+
+func init() {
+	page.NamePageMap["AlertHistory"].Logic = alertHistory
+}
+
+// Parameters of the Alert History page.
+const (
+	// Number of history entries listed on a page
+	alertHistPageSize = 50
+
+	// Max number of history entries scanned for a page (if filtered by alert, device or outcome)
+	maxAlertHistScan = 1000
+)
+
+// alertHistory is the logic implementation of the Alert History page.
+//
+// Form parameters: the optional filters "alertID", "devID", "outcome", "before" and "after",
+// and "cursor", the cursor of the page (listing the entries following the previous page).
+func alertHistory(p *page.Params) {
+	c := p.AppCtx
+	accKey := p.Account.GetKey(c)
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, accKey); p.Err != nil {
+		return
+	}
+	p.Custom["Devices"] = devices
+
+	var geofences []*ds.Geofence
+	if geofences, p.Err = cache.GetGeofenceListForAccKey(c, accKey); p.Err != nil {
+		return
+	}
+
+	var alerts []*ds.Alert
+	var alertKeys []*datastore.Key
+	if alertKeys, p.Err = datastore.NewQuery(ds.ENameAlert).Ancestor(accKey).GetAll(c, &alerts); p.Err != nil {
+		return
+	}
+	devNames := make(map[int64]string, len(devices))
+	for _, d := range devices {
+		devNames[d.KeyID] = d.Name
+	}
+	setAlertTexts(alerts, alertKeys, devNames, geofenceNames(geofences))
+	alertMap := make(map[int64]*ds.Alert, len(alerts))
+	for _, a := range alerts {
+		alertMap[a.KeyID] = a
+	}
+	p.Custom["Alerts"] = alerts
+	p.Custom["AlertMap"] = alertMap
+	p.Custom["RuleTypeMap"] = ds.RuleTypeMap
+	p.Custom["Outcomes"] = ds.Outcomes
+	p.Custom["OutcomeFailed"] = ds.OutcomeFailed
+	p.Custom["RetentionDays"] = ds.AlertHistRetentionDays
+
+	fv := p.Request.FormValue
+
+	// Parse filters:
+	p.Custom["Before"] = fv("before")
+	p.Custom["After"] = fv("after")
+	outcome := fv("outcome")
+	p.Custom["Outcome"] = outcome
+
+	var alertID, devID int64
+	var err error
+	if s := fv("alertID"); s != "" {
+		if alertID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Alert</span>!`)
+			return
+		}
+	}
+	p.Custom["AlertID"] = alertID
+	if s := fv("devID"); s != "" {
+		if devID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Device</span>!`)
+			return
+		}
+	}
+	p.Custom["DevID"] = devID
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		return
+	}
+	// Filters of the page links
+	filters := url.Values{}
+	for _, name := range []string{"alertID", "devID", "outcome", "before", "after"} {
+		if v := fv(name); v != "" {
+			filters.Set(name, v)
+		}
+	}
+
+	q := datastore.NewQuery(ds.ENameAlertHist).Ancestor(accKey).Order("-" + ds.PNameCreated)
+	if !before.IsZero() {
+		q = q.Filter(ds.PNameCreated+"<", before)
+	}
+	if !after.IsZero() {
+		q = q.Filter(ds.PNameCreated+">", after)
+	}
+	if s := fv("cursor"); s != "" {
+		cursor, err := datastore.DecodeCursor(s)
+		if err != nil {
+			p.ErrorMsg = "Invalid page!"
+			return
+		}
+		q = q.Start(cursor)
+		p.Custom["FirstPageURL"] = p.Page.Path + "?" + filters.Encode()
+	}
+
+	// Filters other than the time are applied to the scanned entries
+	var hists []*ds.AlertHist
+	endOfList := false
+	t := q.Run(c)
+	for scanned := 0; len(hists) < alertHistPageSize && scanned < maxAlertHistScan; scanned++ {
+		h := new(ds.AlertHist)
+		key, err := t.Next(h)
+		if err == datastore.Done {
+			endOfList = true
+			break
+		}
+		if err != nil {
+			p.Err = err // Datastore error
+			return
+		}
+		if alertID != 0 && h.AlertID != alertID || devID != 0 && h.DevID != devID || outcome != "" && h.Outcome != outcome {
+			continue
+		}
+		h.KeyID = key.IntID()
+		hists = append(hists, h)
+	}
+	if !endOfList {
+		cursor, err := t.Cursor()
+		if err != nil {
+			p.Err = err // Datastore error
+			return
+		}
+		// Next page: same filters, starting at the cursor
+		filters.Set("cursor", cursor.String())
+		p.Custom["NextPageURL"] = p.Page.Path + "?" + filters.Encode()
+	}
+	p.Custom["MaxAlertHistScan"] = maxAlertHistScan
+
+	if len(hists) == 0 {
+		return
+	}
+
+	// Notification attempts of the listed entries (they have the time of their history entry)
+	histMap := make(map[int64]*ds.AlertHist, len(hists))
+	for _, h := range hists {
+		histMap[h.KeyID] = h
+	}
+	q = datastore.NewQuery(ds.ENameNotification).Ancestor(accKey)
+	q = q.Filter(ds.PNameCreated+">=", hists[len(hists)-1].Created).Filter(ds.PNameCreated+"<=", hists[0].Created)
+	var ntfs []*ds.Notification
+	if _, p.Err = q.GetAll(c, &ntfs); p.Err != nil {
+		return
+	}
+	for _, n := range ntfs {
+		if h := histMap[n.HistID]; h != nil {
+			h.Notifications = append(h.Notifications, n)
+		}
+	}
+
+	loc := p.Account.Location()
+	for _, h := range hists {
+		h.DevName = devNames[h.DevID]
+		h.LogsBefore = h.Created.In(loc).Format(timeLayout)
+	}
+	p.Custom["Hists"] = hists
+}
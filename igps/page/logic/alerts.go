@@ -5,12 +5,14 @@ Alerts page logic.
 package logic
 
 import (
+	"appengine"
 	"appengine/datastore"
 	"html/template"
 	"igps/cache"
 	"igps/ds"
 	"igps/page"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,6 +20,15 @@ func init() {
 	page.NamePageMap["Alerts"].Logic = alerts
 }
 
+// Valid range of the reminder interval of alerts in minutes (besides 0 meaning no reminders).
+const (
+	minReminder = 5
+	maxReminder = 7 * 24 * 60
+)
+
+// Default reminder interval of new alerts in minutes.
+const defReminder = 60
+
 // alerts is the logic implementation of the Alerts page.
 func alerts(p *page.Params) {
 	c := p.AppCtx
@@ -29,49 +40,115 @@ func alerts(p *page.Params) {
 	}
 	p.Custom["Devices"] = devices
 
+	var geofences []*ds.Geofence
+	if geofences, p.Err = cache.GetGeofenceListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Geofences"] = geofences
+
+	var channels []*ds.Channel
+	if channels, p.Err = cache.GetChannelListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Channels"] = channels
+
 	fv := p.Request.PostFormValue
 
 	// Detect form submits:
 	switch {
-	case fv("submitAdd") != "":
-		// Add New Alert form submitted!
-		// Checks:
-		switch {
-		case !checkDeviceID(p, fv("carDeviceID"), true, devices):
-		case !checkDeviceID(p, fv("persMobDeviceID"), false, devices):
-		}
-		if p.ErrorMsg == nil {
-			// So far so good. Futher checks: car and personal mobile device must differ
-			carDevID, _ := strconv.ParseInt(fv("carDeviceID"), 10, 64)
-			var persMobDevID int64
-			if fv("persMobDeviceID") != "" {
-				persMobDevID, _ = strconv.ParseInt(fv("persMobDeviceID"), 10, 64)
-				if carDevID == persMobDevID {
-					p.ErrorMsg = template.HTML(`<span class="code">Car GPS Device</span> and <span class="code">Personal Mobile GPS Device</span> cannot be the same!`)
-				}
+	case fv("submitSave") != "":
+		// Add / Edit Alert form submitted!
+		// Type and Device of edited Alerts cannot be changed (the state of the alert belongs to them).
+		var alertKey *datastore.Key
+		var edited ds.Alert
+		if fv("alertID") != "" {
+			alertID, err := strconv.ParseInt(fv("alertID"), 10, 64)
+			if err != nil {
+				p.ErrorMsg = "Invalid Alert!"
+				break
 			}
-			if p.ErrorMsg == nil {
-				// So far still good. Furter check: same alert cannot be saved twice
-				q := datastore.NewQuery(ds.ENameAlert).Ancestor(p.Account.GetKey(c))
-				var alerts []*ds.Alert
-				if _, p.Err = q.GetAll(c, &alerts); p.Err != nil {
-					return
-				}
-				for _, alert := range alerts {
-					if alert.CarDevID == carDevID && alert.PersMobDevID == persMobDevID {
-						p.ErrorMsg = template.HTML(`An Alert with the same <span class="code">Car GPS Device</span> and <span class="code">Personal Mobile GPS Device</span> already exists!`)
-					}
+			alertKey = datastore.NewKey(c, ds.ENameAlert, "", alertID, p.Account.GetKey(c))
+			if err = datastore.Get(c, alertKey, &edited); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					p.ErrorMsg = "You do not have access to the specified Alert!"
+					break
 				}
+				p.Err = err // Real datastore error
+				return
 			}
-			if p.ErrorMsg == nil {
-				// All data OK, save new Alert
-				alert := ds.Alert{carDevID, persMobDevID, time.Now(), 0, "", ""}
-				if _, p.Err = datastore.Put(c, datastore.NewIncompleteKey(c, ds.ENameAlert, p.Account.GetKey(c)), &alert); p.Err != nil {
-					return // Datastore error
-				}
-				p.InfoMsg = "New Alert saved successfully."
+			p.Custom["EditAlertID"] = alertID
+		}
+		rt := ds.RuleTypeMap[fv("ruleType")]
+		if alertKey != nil {
+			rt = edited.RuleType()
+		}
+		if rt == nil {
+			p.ErrorMsg = "Invalid Alert type! Please select a type from the list."
+			break
+		}
+		devID := edited.DevID
+		if alertKey == nil {
+			if !checkDeviceID(p, fv("deviceID"), rt.DevLabel, false, devices) {
+				break
 			}
+			devID, _ = strconv.ParseInt(fv("deviceID"), 10, 64)
+		}
+		values, ok := checkRuleParams(p, rt, devID, devices, geofences)
+		if !ok {
+			break
+		}
+		reminder, ok := checkReminder(p, fv("reminder"))
+		if !ok || !checkSchedule(p, "Schedule", fv("schedule")) {
+			break
+		}
+		chIDs, ok := checkAlertChannels(p, p.Request.PostForm["channel"], channels)
+		if !ok {
+			break
 		}
+
+		// Same alert cannot be saved twice
+		q := datastore.NewQuery(ds.ENameAlert).Ancestor(p.Account.GetKey(c))
+		var alerts []*ds.Alert
+		var alertKeys []*datastore.Key
+		if alertKeys, p.Err = q.GetAll(c, &alerts); p.Err != nil {
+			return
+		}
+		for i, a := range alerts {
+			if alertKey != nil && alertKeys[i].Equal(alertKey) {
+				continue
+			}
+			if a.GetType() == rt.Name && a.DevID == devID && sameParamValues(a.ParamValues(), values) {
+				p.ErrorMsg = template.HTML(`An Alert with the same type, <span class="code">` + template.HTMLEscapeString(rt.DevLabel) + `</span> and parameters already exists!`)
+				break
+			}
+		}
+		if p.ErrorMsg != nil {
+			break
+		}
+
+		// All data OK, save Alert
+		if alertKey != nil {
+			if p.Err = updateAlert(c, alertKey, rt, values, reminder, strings.TrimSpace(fv("schedule")), fv("critical") != "", chIDs); p.Err != nil {
+				return // Datastore error
+			}
+			delete(p.Custom, "EditAlertID")
+			p.InfoMsg = "Alert saved successfully."
+			break
+		}
+		alert := ds.Alert{Type: rt.Name, DevID: devID, Created: time.Now(), State: ds.StateOK, Reminder: reminder,
+			Schedule: strings.TrimSpace(fv("schedule")), Critical: fv("critical") != "", Channels: chIDs}
+		if alert.Secret, p.Err = NewAlertSecret(); p.Err != nil {
+			return
+		}
+		alert.SetParamValues(values)
+		if rt.Event {
+			// Only events following the creation are notified
+			alert.EventsNotified = alert.Created
+		}
+		if _, p.Err = datastore.Put(c, datastore.NewIncompleteKey(c, ds.ENameAlert, p.Account.GetKey(c)), &alert); p.Err != nil {
+			return // Datastore error
+		}
+		p.InfoMsg = "New Alert saved successfully."
 	case fv("submitDelete") != "":
 		// Delete Alert form submitted!
 		if alertID, err := strconv.ParseInt(string(fv("alertID")), 10, 64); err != nil {
@@ -96,6 +173,32 @@ func alerts(p *page.Params) {
 				p.InfoMsg = "Alert deleted successfully."
 			}
 		}
+	case fv("submitCancelSnooze") != "":
+		// Cancel Snooze form submitted!
+		alertID, err := strconv.ParseInt(fv("alertID"), 10, 64)
+		if err != nil {
+			p.ErrorMsg = "Invalid Alert!"
+			break
+		}
+		alertKey := datastore.NewKey(c, ds.ENameAlert, "", alertID, p.Account.GetKey(c))
+		err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			var alert ds.Alert
+			if err := datastore.Get(tc, alertKey, &alert); err != nil {
+				return err
+			}
+			alert.SnoozedUntil, alert.AckedAt = time.Time{}, time.Time{}
+			_, err := datastore.Put(tc, alertKey, &alert)
+			return err
+		}, nil)
+		switch err {
+		case nil:
+			p.InfoMsg = "Snooze cancelled successfully."
+		case datastore.ErrNoSuchEntity:
+			p.ErrorMsg = "You do not have access to the specified Alert!"
+		default:
+			p.Err = err // Real datastore error
+			return
+		}
 	}
 
 	q := datastore.NewQuery(ds.ENameAlert).Ancestor(p.Account.GetKey(c))
@@ -105,35 +208,192 @@ func alerts(p *page.Params) {
 	if alertKeys, p.Err = q.GetAll(c, &alerts); p.Err != nil {
 		return
 	}
+	devNames := make(map[int64]string, len(devices))
+	for _, d := range devices {
+		devNames[d.KeyID] = d.Name
+	}
+	gfNames := geofenceNames(geofences)
+	chNames := map[int64]string{ds.ChannelAccountEmail: "Account email"}
+	for _, ch := range channels {
+		chNames[ch.KeyID] = ch.Name
+	}
+	setAlertTexts(alerts, alertKeys, devNames, gfNames)
+
+	p.Custom["Alerts"] = alerts
+	p.Custom["ChannelNames"] = chNames
+	p.Custom["RuleTypes"] = ds.RuleTypes
+	p.Custom["ParamDevice"] = ds.ParamDevice
+	p.Custom["ParamGeofence"] = ds.ParamGeofence
+	p.Custom["ParamChoice"] = ds.ParamChoice
+	p.Custom["StateFiring"] = ds.StateFiring
+	p.Custom["Now"] = time.Now()
+	p.Custom["DefReminder"] = defReminder
+	p.Custom["MinReminder"] = minReminder
+	p.Custom["MaxReminder"] = maxReminder
+}
+
+// updateAlert updates the settings of the alert with the specified key in a transaction (the alert check
+// may save the alert concurrently). The state of the alert and its rule checks is kept, unless the parameter
+// values change: conditions met with the old parameters are not notified (see ds.Alert.Reset()).
+func updateAlert(c appengine.Context, alertKey *datastore.Key, rt *ds.RuleType, values map[string]int64, reminder int64, schedule string, critical bool, chIDs []int64) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var alert ds.Alert
+		if err := datastore.Get(tc, alertKey, &alert); err != nil {
+			return err
+		}
+		if !sameParamValues(alert.ParamValues(), values) {
+			now := time.Now()
+			alert.Reset(now)
+			if rt.Event {
+				alert.EventsNotified = now
+			}
+		}
+		// Alerts created before rule types get their type stored
+		alert.Type = rt.Name
+		alert.SetParamValues(values)
+		alert.Reminder, alert.Schedule, alert.Critical, alert.Channels = reminder, schedule, critical, chIDs
+		_, err := datastore.Put(tc, alertKey, &alert)
+		return err
+	}, nil)
+}
+
+// setAlertTexts sets the derived fields of the specified alerts loaded with the specified keys:
+// the key IDs, the names of the monitored devices and the parameter texts.
+func setAlertTexts(alerts []*ds.Alert, alertKeys []*datastore.Key, devNames, gfNames map[int64]string) {
 	for i, alert := range alerts {
 		alert.KeyID = alertKeys[i].IntID()
-		for _, d := range devices {
-			switch d.KeyID {
-			case alert.CarDevID:
-				alert.CarDevName = d.Name
-			case alert.PersMobDevID:
-				alert.PersMobDevName = d.Name
+		alert.DevName = devNames[alert.DevID]
+		if rt := alert.RuleType(); rt != nil {
+			values := alert.ParamValues()
+			for _, rp := range rt.Params {
+				alert.ParamTexts = append(alert.ParamTexts, rp.Label+": "+rp.Format(values[rp.Name], devNames, gfNames))
 			}
 		}
 	}
+}
 
-	p.Custom["Alerts"] = alerts
+// checkSchedule checks the specified schedule (see ds.ParseSchedule()) of the field with the specified label,
+// and sets an appropriate error message if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkSchedule(p *page.Params, label, schedule string) (ok bool) {
+	if _, err := ds.ParseSchedule(schedule); err != nil {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="code">{{index . 0}}</span>: {{index . 1}}`, []interface{}{label, err.Error()})
+		return false
+	}
+	return true
 }
 
-// checkDeviceID checks the specified device ID and sets an appropriate error message
-// if there's something wrong with it.
-// Returns true if is acceptable (valid).
-func checkDeviceID(p *page.Params, devIDst string, isCar bool, devices []*ds.Device) (ok bool) {
-	var fieldName string
-	if isCar {
-		fieldName = `<span class="code">Car GPS Device</span>`
-	} else {
-		fieldName = `<span class="code">Personal Mobile GPS Device</span>`
+// checkAlertChannels checks the specified channel IDs an alert is routed to (ds.ChannelAccountEmail or IDs of channels),
+// and sets an appropriate error message if there's something wrong with them.
+// Returns the channel IDs and true if they are acceptable (valid).
+func checkAlertChannels(p *page.Params, ids []string, channels []*ds.Channel) (chIDs []int64, ok bool) {
+	if len(ids) == 0 {
+		p.ErrorMsg = "At least one Channel must be selected!"
+		return nil, false
+	}
+	for _, s := range ids {
+		chID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || chID != ds.ChannelAccountEmail && channelByID(channels, chID) == nil {
+			p.ErrorMsg = "You do not have access to the specified Channel!"
+			return nil, false
+		}
+		chIDs = append(chIDs, chID)
 	}
+	return chIDs, true
+}
+
+// checkReminder checks the specified reminder interval (in minutes),
+// and sets an appropriate error message if there's something wrong with it.
+// Returns the reminder interval and true if it is acceptable (valid).
+func checkReminder(p *page.Params, reminder string) (minutes int64, ok bool) {
+	reminder = strings.TrimSpace(reminder)
+	if reminder == "" {
+		return 0, true
+	}
+	var err error
+	if minutes, err = strconv.ParseInt(reminder, 10, 64); err != nil || minutes != 0 && (minutes < minReminder || minutes > maxReminder) {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="code">Reminder</span>! Valid values: 0 (no reminders) or {{index . 0}}..{{index . 1}} minutes.`, []int{minReminder, maxReminder})
+		return 0, false
+	}
+	return minutes, true
+}
+
+// checkRuleParams checks the parameters of the specified rule type submitted in the "<ruleType>.<param>" form values,
+// and returns the parameter values. devID is the ID of the monitored device, device parameters must differ from it.
+// Sets an appropriate error message and returns false if a parameter is invalid.
+func checkRuleParams(p *page.Params, rt *ds.RuleType, devID int64, devices []*ds.Device, geofences []*ds.Geofence) (values map[string]int64, ok bool) {
+	values = make(map[string]int64, len(rt.Params))
+	for _, rp := range rt.Params {
+		fieldName := `<span class="code">` + template.HTMLEscapeString(rp.Label) + `</span>`
+		s := strings.TrimSpace(p.Request.PostFormValue(rt.Name + "." + rp.Name))
+
+		switch rp.Kind {
+		case ds.ParamDevice:
+			if !checkDeviceID(p, s, rp.Label, rp.Optional, devices) {
+				return nil, false
+			}
+			if s != "" {
+				values[rp.Name], _ = strconv.ParseInt(s, 10, 64)
+				if values[rp.Name] == devID {
+					p.ErrorMsg = template.HTML(`<span class="code">` + template.HTMLEscapeString(rt.DevLabel) + `</span> and ` + fieldName + ` cannot be the same!`)
+					return nil, false
+				}
+			}
+		case ds.ParamGeofence:
+			gfID, err := strconv.ParseInt(s, 10, 64)
+			if s == "" {
+				p.ErrorMsg = SExecTempl(fieldName+` must be provided! Please select a Geofence from the list, or add one on the {{.}} page.`, page.NamePageMap["Geofences"].Link())
+				return nil, false
+			}
+			if err != nil || geofenceByID(geofences, gfID) == nil {
+				p.ErrorMsg = "You do not have access to the specified Geofence! Please select a Geofence from the list."
+				return nil, false
+			}
+			values[rp.Name] = gfID
+		case ds.ParamChoice:
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || rp.Choice(v) == "" {
+				p.ErrorMsg = template.HTML("Invalid " + fieldName + "! Please select a value from the list.")
+				return nil, false
+			}
+			values[rp.Name] = v
+		default:
+			v := rp.Def
+			if s != "" {
+				var err error
+				if v, err = strconv.ParseInt(s, 10, 64); err != nil || v < rp.Min || v > rp.Max {
+					p.ErrorMsg = SExecTempl(`Invalid `+fieldName+`! Valid range: {{.Min}}..{{.Max}} {{.Unit}}`, rp)
+					return nil, false
+				}
+			}
+			values[rp.Name] = v
+		}
+	}
+
+	return values, true
+}
+
+// sameParamValues tells if the specified parameter values are the same.
+func sameParamValues(values, values2 map[string]int64) bool {
+	if len(values) != len(values2) {
+		return false
+	}
+	for name, v := range values {
+		if v2, ok := values2[name]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDeviceID checks the specified device ID of the field with the specified label,
+// and sets an appropriate error message if there's something wrong with it.
+// Returns true if is acceptable (valid).
+func checkDeviceID(p *page.Params, devIDst, label string, optional bool, devices []*ds.Device) (ok bool) {
+	fieldName := `<span class="code">` + template.HTMLEscapeString(label) + `</span>`
 
 	if devIDst == "" {
-		if !isCar {
-			// Personal Mobile device is optional
+		if optional {
 			return true
 		}
 		p.ErrorMsg = template.HTML(fieldName + " must be provided! Please select a Device from the list.")
@@ -0,0 +1,256 @@
+/*
+Notification channel management of the Settings page.
+*/
+
+package logic
+
+import (
+	"appengine/datastore"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"igps/cache"
+	"igps/ds"
+	"igps/notify"
+	"igps/page"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manageChannels handles the channel forms of the Settings page (adding, deleting and testing channels),
+// and provides the channels of the account to the page.
+func manageChannels(p *page.Params) {
+	c := p.AppCtx
+	fv := p.Request.PostFormValue
+	accKey := p.Account.GetKey(c)
+
+	var channels []*ds.Channel
+	if channels, p.Err = cache.GetChannelListForAccKey(c, accKey); p.Err != nil {
+		return
+	}
+
+	// Detect form submits:
+	switch {
+	case fv("submitAddChannel") != "":
+		// Add Channel form submitted!
+		ch := ds.Channel{Name: strings.TrimSpace(fv("channelName")), Type: fv("channelType"), Target: strings.TrimSpace(fv("channelTarget")), Created: time.Now()}
+		// Checks:
+		switch {
+		case !checkName(p, fv("channelName")):
+		case !checkChannelNameUnique(p, channels, fv("channelName")):
+		case !checkChannelTarget(p, ch.Type, ch.Target):
+		case !ch.Gateway():
+		case !checkAuthHeader(p, fv("authHeader")):
+		case !checkBodyTemplate(p, fv("bodyTemplate")):
+		default:
+			ch.AuthHeader, ch.BodyTemplate = strings.TrimSpace(fv("authHeader")), strings.TrimSpace(fv("bodyTemplate"))
+			ch.Recipients, _ = checkRecipients(p, fv("recipients"))
+		}
+		if p.ErrorMsg != nil {
+			// Submitted values
+			p.Custom["ChannelName"] = fv("channelName")
+			p.Custom["ChannelType"] = fv("channelType")
+			p.Custom["ChannelTarget"] = fv("channelTarget")
+			p.Custom["Recipients"] = fv("recipients")
+			p.Custom["AuthHeader"] = fv("authHeader")
+			p.Custom["BodyTemplate"] = fv("bodyTemplate")
+			break
+		}
+		if ch.Type == ds.ChannelWebhook {
+			b := make([]byte, 24) // Multiple of 3 bytes (ideal for base64 encoding so no padding '=' signs will be needed)
+			if _, p.Err = rand.Read(b); p.Err != nil {
+				return
+			}
+			ch.Secret = base64.URLEncoding.EncodeToString(b)
+		}
+		// All data OK, save Channel
+		if _, p.Err = datastore.Put(c, datastore.NewIncompleteKey(c, ds.ENameChannel, accKey), &ch); p.Err != nil {
+			return // Datastore error
+		}
+		p.InfoMsg = "Channel saved successfully."
+		// Clear from memcache:
+		cache.ClearChannelListForAccKey(c, accKey)
+	case fv("submitDelChannel") != "":
+		// Delete Channel form submitted!
+		chID, err := strconv.ParseInt(fv("channelID"), 10, 64)
+		if err != nil || channelByID(channels, chID) == nil {
+			p.ErrorMsg = "You do not have access to the specified Channel!"
+			break
+		}
+		// Channels alerts are routed to cannot be deleted
+		var alerts []*ds.Alert
+		if _, p.Err = datastore.NewQuery(ds.ENameAlert).Ancestor(accKey).GetAll(c, &alerts); p.Err != nil {
+			return
+		}
+		for _, a := range alerts {
+			for _, id := range a.Channels {
+				if id == chID {
+					p.ErrorMsg = SExecTempl(`Alerts are routed to the Channel! Delete them first on the {{.}} page.`, page.NamePageMap["Alerts"].Link())
+				}
+			}
+		}
+		if p.ErrorMsg != nil {
+			break
+		}
+		if p.Err = datastore.Delete(c, datastore.NewKey(c, ds.ENameChannel, "", chID, accKey)); p.Err != nil {
+			return // Datastore error
+		}
+		p.InfoMsg = "Channel deleted successfully."
+		// Clear from memcache:
+		cache.ClearChannelListForAccKey(c, accKey)
+	case fv("submitTestChannel") != "":
+		// Send test message form submitted!
+		chID, err := strconv.ParseInt(fv("channelID"), 10, 64)
+		ch := channelByID(channels, chID)
+		if err != nil || ch == nil {
+			p.ErrorMsg = "You do not have access to the specified Channel!"
+			break
+		}
+		n := notify.ForChannel(ch)
+		if n == nil {
+			p.ErrorMsg = "Invalid Channel type!"
+			break
+		}
+		msg := &notify.Message{Subject: "Test message", Body: fmt.Sprintf(testMessageMail, ch.Name), Test: true}
+		if err := n.Notify(c, msg); err != nil {
+			c.Warningf("Failed to send test message: %v", err)
+			p.ErrorMsg = SExecTempl(`Failed to send test message to Channel <span class="highlight">{{index . 0}}</span>: {{index . 1}}`, []interface{}{ch.Name, err.Error()})
+			break
+		}
+		p.InfoMsg = SExecTempl(`Test message sent to Channel <span class="highlight">{{.}}</span>.`, ch.Name)
+	}
+
+	if p.InfoMsg != nil {
+		// Channels changed, reload them (ancestor queries are strongly consistent).
+		if channels, p.Err = cache.GetChannelListForAccKey(c, accKey); p.Err != nil {
+			return
+		}
+	}
+
+	p.Custom["Channels"] = channels
+	p.Custom["ChannelTypes"] = ds.ChannelTypes
+	p.Custom["MaxRecipients"] = maxRecipients
+	p.Custom["SMSMaxLen"] = notify.SMSMaxLen
+	p.Custom["ChatMaxLen"] = notify.ChatMaxLen
+	p.Custom["PlaceholderTo"] = notify.PlaceholderTo
+	p.Custom["PlaceholderText"] = notify.PlaceholderText
+}
+
+// Max number of recipients of a gateway channel.
+const maxRecipients = 20
+
+// checkChannelNameUnique checks if the specified Channel name is unique (case-insensitive) among the channels,
+// and sets an appropriate error message if not.
+// Returns true if is acceptable (unique).
+func checkChannelNameUnique(p *page.Params, channels []*ds.Channel, name string) (ok bool) {
+	name = strings.TrimSpace(name)
+	for _, ch := range channels {
+		if strings.EqualFold(ch.Name, name) {
+			p.ErrorMsg = SExecTempl(`You already have a Channel named <span class="highlight">{{.}}</span>!`, ch.Name)
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkChannelTarget checks the specified target of a channel of the specified type,
+// and sets an appropriate error message if there's something wrong with it.
+// Returns true if is acceptable (valid).
+func checkChannelTarget(p *page.Params, chType, target string) (ok bool) {
+	if len(target) > 500 {
+		p.ErrorMsg = `Channel target is too long! (cannot be longer than 500 characters)`
+		return false
+	}
+
+	switch chType {
+	case ds.ChannelEmail:
+		if _, err := mail.ParseAddressList(target); err != nil {
+			p.ErrorMsg = `Invalid email addresses! Provide a comma separated list of email addresses.`
+			return false
+		}
+	case ds.ChannelWebhook:
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			p.ErrorMsg = `Invalid webhook URL! Provide an absolute http:// or https:// URL.`
+			return false
+		}
+	case ds.ChannelSMS, ds.ChannelChat:
+		u, err := url.Parse(strings.NewReplacer(notify.PlaceholderTo, "x", notify.PlaceholderText, "x").Replace(target))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			p.ErrorMsg = `Invalid gateway URL template! Provide an absolute http:// or https:// URL.`
+			return false
+		}
+	default:
+		p.ErrorMsg = "Invalid Channel type! Please select a type from the list."
+		return false
+	}
+
+	return true
+}
+
+// checkAuthHeader checks the specified auth header of a gateway channel,
+// and sets an appropriate error message if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkAuthHeader(p *page.Params, header string) (ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+	if i := strings.Index(header, ":"); i <= 0 || len(header) > 500 || strings.ContainsAny(header, "\r\n") {
+		p.ErrorMsg = template.HTML(`Invalid <span class="code">Auth header</span>! Format: <span class="code">"Name: value"</span>`)
+		return false
+	}
+	return true
+}
+
+// checkBodyTemplate checks the specified body template of a gateway channel,
+// and sets an appropriate error message if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkBodyTemplate(p *page.Params, templ string) (ok bool) {
+	if len(templ) > 2000 {
+		p.ErrorMsg = template.HTML(`<span class="code">Body template</span> is too long! (cannot be longer than 2000 characters)`)
+		return false
+	}
+	return true
+}
+
+// checkRecipients checks the specified recipients (phone numbers or chat IDs, separated by commas or new lines)
+// of a gateway channel, and sets an appropriate error message if there's something wrong with them.
+// Returns the recipients and true if they are acceptable (valid).
+func checkRecipients(p *page.Params, recipients string) (rcps []string, ok bool) {
+	for _, r := range strings.FieldsFunc(recipients, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if len(r) > 100 {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="code">Recipient</span>: <span class="highlight">{{.}}</span>`, r)
+			return nil, false
+		}
+		rcps = append(rcps, r)
+	}
+	if len(rcps) == 0 || len(rcps) > maxRecipients {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="code">Recipients</span>! Provide 1..{{.}} phone numbers or chat IDs.`, maxRecipients)
+		return nil, false
+	}
+	return rcps, true
+}
+
+// channelByID returns the Channel with the specified ID from channels, or nil if not found.
+func channelByID(channels []*ds.Channel, chID int64) *ds.Channel {
+	for _, ch := range channels {
+		if ch.KeyID == chID {
+			return ch
+		}
+	}
+	return nil
+}
+
+const testMessageMail = `This is a test message from IczaGPS to the notification channel "%s".
+
+If you received it, the channel is configured properly.
+`
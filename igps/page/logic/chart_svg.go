@@ -0,0 +1,208 @@
+/*
+Server-side SVG rendering of time charts.
+*/
+
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"time"
+)
+
+// Paddings of the plot area in SVG charts, in pixels.
+const (
+	chartPadLeft   = 50
+	chartPadRight  = 12
+	chartPadTop    = 24
+	chartPadBottom = 22
+)
+
+// Colors of SVG charts.
+const (
+	clrChart      = "#0000ff"
+	clrGap        = "#f6c4c4"
+	clrGapStopped = "#e2e2e2"
+)
+
+// Max number of points a line chart marks with dots.
+const maxChartDots = 500
+
+// chartFrame is the frame of an SVG chart: the time range, the highlighted gaps and the axes.
+type chartFrame struct {
+	t0, t1 time.Time
+	loc    *time.Location // Location to display times in
+	gaps   []*chartGap
+
+	width, height int
+
+	// Max value of the Y axis, set by begin()
+	maxV float64
+}
+
+// x returns the X pixel coordinate of the specified time.
+func (f *chartFrame) x(t time.Time) float64 {
+	w := float64(f.width - chartPadLeft - chartPadRight)
+	return chartPadLeft + w*float64(t.Sub(f.t0))/float64(f.t1.Sub(f.t0))
+}
+
+// y returns the Y pixel coordinate of the specified value.
+func (f *chartFrame) y(v float64) float64 {
+	h := float64(f.height - chartPadTop - chartPadBottom)
+	return float64(f.height-chartPadBottom) - h*v/f.maxV
+}
+
+// begin writes the start of the SVG image of a chart with the specified title and unit,
+// and values up to maxV: the background, the gaps, the grid and the axes.
+func (f *chartFrame) begin(b *bytes.Buffer, title, unit string, maxV float64) {
+	f.maxV = niceCeil(maxV)
+
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Arial, sans-serif" font-size="11">`, f.width, f.height, f.width, f.height)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="#fff" stroke="#888"/>`, f.width, f.height)
+	if unit != "" {
+		title += " [" + unit + "]"
+	}
+	fmt.Fprintf(b, `<text x="%d" y="15" font-weight="bold">%s</text>`, chartPadLeft, html.EscapeString(title))
+
+	// Legend of gaps
+	lx := f.width - chartPadRight - 200
+	fmt.Fprintf(b, `<rect x="%d" y="6" width="10" height="10" fill="%s"/><text x="%d" y="15">No records</text>`, lx, clrGap, lx+14)
+	fmt.Fprintf(b, `<rect x="%d" y="6" width="10" height="10" fill="%s"/><text x="%d" y="15">Stopped</text>`, lx+100, clrGapStopped, lx+114)
+
+	// GAPS
+
+	top, bottom := float64(chartPadTop), float64(f.height-chartPadBottom)
+	for _, g := range f.gaps {
+		clr, what := clrGap, "No records"
+		if g.Stopped {
+			clr, what = clrGapStopped, "Stopped"
+		}
+		x0, x1 := f.x(g.From), f.x(g.To)
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s - %s (%v)</title></rect>`,
+			x0, top, math.Max(x1-x0, 1), bottom-top, clr, what,
+			g.From.In(f.loc).Format("01-02 15:04"), g.To.In(f.loc).Format("01-02 15:04"), g.Duration())
+	}
+
+	// GRID AND Y AXIS
+
+	for i := 0; i <= 4; i++ {
+		v := f.maxV * float64(i) / 4
+		y := f.y(v)
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, chartPadLeft, y, f.width-chartPadRight, y)
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end">%g</text>`, chartPadLeft-4, y+4, v)
+	}
+
+	// X AXIS
+
+	// Tick step in hours: at most 12 ticks
+	hours := f.t1.Sub(f.t0).Hours()
+	step := 24
+	for _, s := range []int{1, 2, 3, 6, 12} {
+		if hours/float64(s) <= 12 {
+			step = s
+			break
+		}
+	}
+	for _, t := range hourStarts(f.t0, f.t1, f.loc) {
+		lt := t.In(f.loc)
+		if t.Before(f.t0) || lt.Hour()%step != 0 {
+			continue
+		}
+		label := lt.Format("15:04")
+		if lt.Hour() == 0 {
+			label = lt.Format("01-02")
+		}
+		x := f.x(t)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#888"/>`, x, bottom, x, bottom+4)
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`, x, bottom+15, label)
+	}
+
+	fmt.Fprintf(b, `<polyline fill="none" stroke="#888" points="%d,%d %d,%.1f %d,%.1f"/>`,
+		chartPadLeft, chartPadTop, chartPadLeft, bottom, f.width-chartPadRight, bottom)
+}
+
+// end writes the end of the SVG image of a chart.
+func (f *chartFrame) end(b *bytes.Buffer) {
+	b.WriteString(`</svg>`)
+}
+
+// renderLineChart renders a line chart of the specified points (must be in chronological order).
+// The line is broken where consecutive points are farther than gap from each other.
+func renderLineChart(b *bytes.Buffer, f *chartFrame, title, unit string, points []chartPoint, gap time.Duration) {
+	var maxV float64
+	for _, pt := range points {
+		maxV = math.Max(maxV, pt.V)
+	}
+	f.begin(b, title, unit, maxV)
+
+	for i := 0; i < len(points); {
+		j := i + 1
+		for ; j < len(points) && points[j].T.Sub(points[j-1].T) <= gap; j++ {
+		}
+		// Points i..j-1 form a line
+		fmt.Fprintf(b, `<polyline fill="none" stroke="%s" stroke-width="1.5" stroke-linejoin="round" points="`, clrChart)
+		for k := i; k < j; k++ {
+			if k > i {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(b, "%.1f,%.1f", f.x(points[k].T), f.y(points[k].V))
+		}
+		b.WriteString(`"/>`)
+		i = j
+	}
+
+	if len(points) <= maxChartDots {
+		for _, pt := range points {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"><title>%s: %.1f %s</title></circle>`,
+				f.x(pt.T), f.y(pt.V), clrChart, pt.T.In(f.loc).Format("01-02 15:04:05"), pt.V, unit)
+		}
+	}
+
+	f.end(b)
+}
+
+// renderBarChart renders a bar chart of hourly values: values[i] is the value of the hour starting at starts[i]
+// (see hourStarts()).
+func renderBarChart(b *bytes.Buffer, f *chartFrame, title, unit string, starts []time.Time, values []float64) {
+	var maxV float64
+	for _, v := range values {
+		maxV = math.Max(maxV, v)
+	}
+	f.begin(b, title, unit, maxV)
+
+	for i, v := range values {
+		if v <= 0 {
+			continue
+		}
+		t0, t1 := starts[i], starts[i].Add(time.Hour)
+		if t0.Before(f.t0) {
+			t0 = f.t0
+		}
+		if t1.After(f.t1) {
+			t1 = f.t1
+		}
+		x0, x1, y := f.x(t0), f.x(t1), f.y(v)
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.7"><title>%s: %g %s</title></rect>`,
+			x0+0.5, y, math.Max(x1-x0-1, 1), float64(f.height-chartPadBottom)-y, clrChart,
+			starts[i].In(f.loc).Format("01-02 15:04"), math.Floor(v*100+0.5)/100, unit)
+	}
+
+	f.end(b)
+}
+
+// niceCeil returns the smallest "nice" number (1, 2 or 5 times a power of 10) not less than v.
+// Returns 1 for non-positive values.
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	e := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5} {
+		if v <= m*e {
+			return m * e
+		}
+	}
+	return 10 * e
+}
@@ -0,0 +1,243 @@
+/*
+Charts page logic: speed, distance and reporting frequency charts of a Device.
+*/
+
+package logic
+
+import (
+	"bytes"
+	"html/template"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Charts"].Logic = charts
+}
+
+// Parameters of the Charts page.
+const (
+	// Max number of GPS records to chart
+	maxChartRecords = 10000
+
+	// Default time range if no After filter is specified
+	defChartRange = 24 * time.Hour
+	// Max time range
+	maxChartRange = 7 * 24 * time.Hour
+
+	// Default min gap duration in minutes
+	defChartGap = 15
+	// Max min gap duration in minutes
+	maxChartGap = 24 * 60
+
+	// Size of the charts in pixels
+	chartWidth, chartHeight = 800, 200
+)
+
+// charts is the logic implementation of the Charts page.
+//
+// Form parameters: "devID", the optional "before" and "after" time filters (same as on the Logs page,
+// the last 24 hours before the Before filter is charted if After is not specified)
+// and the optional "gap", the min duration in minutes of periods without records highlighted as gaps.
+func charts(p *page.Params) {
+	c := p.AppCtx
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Devices"] = devices
+
+	fv := p.Request.FormValue
+
+	p.Custom["Before"] = fv("before")
+	p.Custom["After"] = fv("after")
+	p.Custom["Gap"] = defChartGap
+	if fv("gap") != "" {
+		p.Custom["Gap"] = fv("gap")
+	}
+	p.Custom["MaxRecords"] = maxChartRecords
+
+	if fv("devID") == "" {
+		// No device chosen yet
+		return
+	}
+
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		return
+	}
+	p.Custom["Device"] = dev
+
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		return
+	}
+	gap, ok := parseChartGap(p)
+	if !ok {
+		return
+	}
+
+	t1 := before
+	if t1.IsZero() {
+		t1 = time.Now()
+	}
+	t0 := after
+	if t0.IsZero() {
+		t0 = t1.Add(-defChartRange)
+	}
+	if !t0.Before(t1) {
+		p.ErrorMsg = template.HTML(`<span class="highlight">After</span> must be earlier than <span class="highlight">Before</span>!`)
+		return
+	}
+	if t1.Sub(t0) > maxChartRange {
+		p.ErrorMsg = template.HTML(`The time range between <span class="highlight">After</span> and <span class="highlight">Before</span> must not exceed 7 days!`)
+		return
+	}
+
+	records, truncated, err := loadRecords(c, dev.KeyID, t1, t0, -1, maxChartRecords)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	p.Custom["Truncated"] = truncated
+	if truncated {
+		// Only the latest records are loaded, chart from the first of them
+		t0 = records[0].Created
+	}
+	p.Custom["From"] = t0
+	p.Custom["To"] = t1
+
+	if len(records) == 0 {
+		p.Custom["NoRecords"] = true
+		return
+	}
+
+	// Same metrics as displayed on the Logs page
+	calcMetrics(records)
+
+	loc := p.Account.Location()
+	gaps := findGaps(records, t0, t1, gap)
+
+	var speeds []chartPoint
+	var dist int64
+	var maxSpeed float64
+	for _, r := range records {
+		if !r.Track() || !r.Metrics() || r.Dt <= 0 {
+			continue
+		}
+		v := float64(r.Dd) / r.Dt.Hours() / 1000
+		speeds = append(speeds, chartPoint{T: r.Created, V: v})
+		dist += r.Dd
+		if v > maxSpeed {
+			maxSpeed = v
+		}
+	}
+
+	starts := hourStarts(t0, t1, loc)
+	dists := make([]float64, len(starts))
+	counts := make([]float64, len(starts))
+	for _, r := range records {
+		i := int(r.Created.Sub(starts[0]) / time.Hour)
+		if i < 0 || i >= len(starts) {
+			continue
+		}
+		counts[i]++
+		if r.Track() && r.Metrics() {
+			dists[i] += float64(r.Dd) / 1000
+		}
+	}
+
+	f := &chartFrame{t0: t0, t1: t1, loc: loc, gaps: gaps, width: chartWidth, height: chartHeight}
+
+	buf := &bytes.Buffer{}
+	renderLineChart(buf, f, "Speed", "km/h", speeds, gap)
+	p.Custom["SpeedSVG"] = template.HTML(buf.String())
+
+	buf.Reset()
+	renderBarChart(buf, f, "Distance per hour", "km", starts, dists)
+	p.Custom["DistSVG"] = template.HTML(buf.String())
+
+	buf.Reset()
+	renderBarChart(buf, f, "Records per hour", "", starts, counts)
+	p.Custom["FreqSVG"] = template.HTML(buf.String())
+
+	var gapDur time.Duration
+	for _, g := range gaps {
+		if !g.Stopped {
+			gapDur += g.To.Sub(g.From)
+		}
+	}
+
+	p.Custom["Count"] = len(records)
+	p.Custom["DistKm"] = float64(dist) / 1000
+	p.Custom["MaxSpeed"] = maxSpeed
+	p.Custom["Gaps"] = gaps
+	p.Custom["GapDur"] = gapDur / time.Second * time.Second
+}
+
+// parseChartGap parses the min gap duration from the "gap" form value (minutes).
+// Default is returned if not specified.
+// Sets an appropriate error message and returns false if the value is invalid.
+func parseChartGap(p *page.Params) (gap time.Duration, ok bool) {
+	mins := defChartGap
+	if s := strings.TrimSpace(p.Request.FormValue("gap")); s != "" {
+		var err error
+		if mins, err = strconv.Atoi(s); err != nil || mins < 1 || mins > maxChartGap {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">Gap</span>! Valid range: 1..{{.}} minutes`, maxChartGap)
+			return
+		}
+	}
+
+	return time.Duration(mins) * time.Minute, true
+}
+
+// chartPoint is a value of a chart at a point in time.
+type chartPoint struct {
+	T time.Time
+	V float64
+}
+
+// chartGap is a period without records.
+type chartGap struct {
+	From, To time.Time
+
+	// Tells if the device was stopped during the gap (the gap follows a Stop event),
+	// in which case no records are expected
+	Stopped bool
+}
+
+// Duration returns the duration of the gap, truncated to seconds.
+func (g *chartGap) Duration() time.Duration {
+	return g.To.Sub(g.From) / time.Second * time.Second
+}
+
+// findGaps returns the periods longer than gap without records in the time range t0..t1.
+// records must be in chronological order.
+func findGaps(records []*ds.GPS, t0, t1 time.Time, gap time.Duration) (gaps []*chartGap) {
+	prev, stopped := t0, false
+	for _, r := range records {
+		if r.Created.Sub(prev) > gap {
+			gaps = append(gaps, &chartGap{From: prev, To: r.Created, Stopped: stopped})
+		}
+		prev, stopped = r.Created, r.Evt() == ds.EvtStop
+	}
+	if t1.Sub(prev) > gap {
+		gaps = append(gaps, &chartGap{From: prev, To: t1, Stopped: stopped})
+	}
+
+	return
+}
+
+// hourStarts returns the start times of the hours (in the specified location) overlapping the time range t0..t1.
+func hourStarts(t0, t1 time.Time, loc *time.Location) (starts []time.Time) {
+	l := t0.In(loc)
+	for t := time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), 0, 0, 0, loc); t.Before(t1); t = t.Add(time.Hour) {
+		starts = append(starts, t)
+	}
+	return
+}
@@ -0,0 +1,270 @@
+/*
+Coverage page logic: reporting health of a Device, the gaps in its records and its uptime per day.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Coverage"].Logic = coverage
+}
+
+// Parameters of the Coverage page.
+const (
+	// Default number of days to report
+	defCoverageDays = 7
+	// Max number of days to report
+	maxCoverageDays = 31
+
+	// Max number of GPS records to process
+	maxCoverageRecords = 100000
+
+	// Max number of gaps to list
+	maxCoverageGaps = 20
+)
+
+// coverageGap is a gap in the records of a device.
+type coverageGap struct {
+	chartGap
+
+	// Distance in meters between the locations before and after the gap, -1 if unknown.
+	// A device moving while not reporting indicates a faulty device.
+	Moved int64
+
+	// Before filter of the Logs page listing the records preceding the end of the gap
+	LogsBefore string
+}
+
+// coverageDay is the coverage of a day.
+type coverageDay struct {
+	Day time.Time
+
+	// Number of records of the day
+	Count int
+
+	// Duration of gaps explained by Stop events and not explained (missing records) in the day
+	Stopped, Missing time.Duration
+
+	// Length of the day (the current day is only reported until now)
+	Length time.Duration
+}
+
+// Uptime returns the percentage of the day not covered by unexplained gaps.
+func (d *coverageDay) Uptime() float64 {
+	return 100 - 100*float64(d.Missing)/float64(d.Length)
+}
+
+// byDurationDesc sorts gaps by duration, longest first.
+type byDurationDesc []*coverageGap
+
+func (s byDurationDesc) Len() int           { return len(s) }
+func (s byDurationDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDurationDesc) Less(i, j int) bool { return s[i].To.Sub(s[i].From) > s[j].To.Sub(s[j].From) }
+
+// coverage is the logic implementation of the Coverage page.
+//
+// Form parameters: "devID", the optional "days", the number of days to report (ending today),
+// and the optional "gap", the min duration in minutes of periods without records considered gaps.
+func coverage(p *page.Params) {
+	c := p.AppCtx
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Devices"] = devices
+
+	fv := p.Request.FormValue
+
+	p.Custom["Days"] = defCoverageDays
+	if fv("days") != "" {
+		p.Custom["Days"] = fv("days")
+	}
+	p.Custom["Gap"] = defChartGap
+	if fv("gap") != "" {
+		p.Custom["Gap"] = fv("gap")
+	}
+	p.Custom["MaxGaps"] = maxCoverageGaps
+
+	if fv("devID") == "" {
+		// No device chosen yet
+		return
+	}
+
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		return
+	}
+	p.Custom["Device"] = dev
+
+	days := defCoverageDays
+	if s := strings.TrimSpace(fv("days")); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 || days > maxCoverageDays {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">Days</span>! Valid range: 1..{{.}}`, maxCoverageDays)
+			return
+		}
+	}
+	gap, ok := parseChartGap(p)
+	if !ok {
+		return
+	}
+
+	loc := p.Account.Location()
+	t1 := time.Now().In(loc)
+	t0 := time.Date(t1.Year(), t1.Month(), t1.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1-days)
+
+	var covDays []*coverageDay
+	for d := t0; d.Before(t1); d = d.AddDate(0, 0, 1) {
+		end := d.AddDate(0, 0, 1)
+		if end.After(t1) {
+			end = t1
+		}
+		covDays = append(covDays, &coverageDay{Day: d, Length: end.Sub(d)})
+	}
+
+	gaps, truncated, err := findCoverageGaps(c, dev.KeyID, t0, t1, gap, covDays)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	p.Custom["Truncated"] = truncated
+	p.Custom["MaxRecords"] = maxCoverageRecords
+
+	// Add up gaps per day
+	var missing []*coverageGap
+	for _, g := range gaps {
+		if !g.Stopped {
+			missing = append(missing, g)
+		}
+		for _, d := range covDays {
+			from, to := g.From, g.To
+			if end := d.Day.Add(d.Length); to.After(end) {
+				to = end
+			}
+			if from.Before(d.Day) {
+				from = d.Day
+			}
+			if !from.Before(to) {
+				continue
+			}
+			if g.Stopped {
+				d.Stopped += to.Sub(from)
+			} else {
+				d.Missing += to.Sub(from)
+			}
+		}
+	}
+
+	var total, totalMissing time.Duration
+	for _, d := range covDays {
+		total += d.Length
+		totalMissing += d.Missing
+		d.Stopped = d.Stopped / time.Second * time.Second
+		d.Missing = d.Missing / time.Second * time.Second
+	}
+
+	sort.Sort(byDurationDesc(missing))
+	if len(missing) > maxCoverageGaps {
+		missing = missing[:maxCoverageGaps]
+	}
+	for _, g := range missing {
+		g.LogsBefore = g.To.In(loc).Format(timeLayout)
+	}
+
+	// Latest day first
+	for i, j := 0, len(covDays)-1; i < j; i, j = i+1, j-1 {
+		covDays[i], covDays[j] = covDays[j], covDays[i]
+	}
+
+	p.Custom["CovDays"] = covDays
+	p.Custom["Gaps"] = missing
+	p.Custom["GapCount"] = len(gaps)
+	p.Custom["Uptime"] = 100 - 100*float64(totalMissing)/float64(total)
+}
+
+// findCoverageGaps returns the gaps longer than gap in the records of the specified device in the time range t0..t1,
+// in reverse chronological order. The records are counted per day in days.
+//
+// Records are iterated without keeping them in memory, so long time ranges can be processed.
+// At most maxCoverageRecords records are processed, in which case truncated is true and the range
+// before the earliest processed record is treated as unknown (not a gap).
+func findCoverageGaps(c appengine.Context, devID int64, t0, t1 time.Time, gap time.Duration, days []*coverageDay) (gaps []*coverageGap, truncated bool, err error) {
+	// The record preceding the time range tells if the device was stopped at its start
+	prevs, _, err := loadRecords(c, devID, t0, time.Time{}, -1, 1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	later := t1                     // Time of the record following the current one (initially the end of the range)
+	var laterGP *appengine.GeoPoint // Location of the first Track record following the current one
+	var pending []*coverageGap      // Gaps waiting for the location before them
+
+	// addGap adds the gap between from and later if it is longer than gap.
+	addGap := func(from time.Time, stopped bool) {
+		if later.Sub(from) <= gap {
+			return
+		}
+		g := &coverageGap{chartGap: chartGap{From: from, To: later, Stopped: stopped}, Moved: -1}
+		gaps = append(gaps, g)
+		if laterGP != nil {
+			pending = append(pending, g)
+		}
+	}
+
+	// setLoc sets the location of the current Track record as the location before the pending gaps.
+	setLoc := func(gp appengine.GeoPoint) {
+		for _, g := range pending {
+			g.Moved = Distance(gp.Lat, gp.Lng, laterGP.Lat, laterGP.Lng)
+		}
+		pending = nil
+		laterGP = &gp
+	}
+
+	q := gpsQuery(devID, t1, t0.Add(-time.Microsecond), -1).Order("-" + ds.PNameCreated).Limit(maxCoverageRecords + 1)
+	count := 0
+	for it := q.Run(c); ; {
+		var r ds.GPS
+		if _, err = it.Next(&r); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+		if count++; count > maxCoverageRecords {
+			return gaps, true, nil
+		}
+
+		addGap(r.Created, r.Evt() == ds.EvtStop)
+		later = r.Created
+		if r.Track() {
+			setLoc(r.GeoPoint)
+		}
+
+		for _, d := range days {
+			if !r.Created.Before(d.Day) && r.Created.Before(d.Day.Add(d.Length)) {
+				d.Count++
+				break
+			}
+		}
+	}
+
+	// Gap at the start of the range
+	stopped := len(prevs) > 0 && prevs[0].Evt() == ds.EvtStop
+	addGap(t0, stopped)
+	if len(prevs) > 0 && prevs[0].Track() {
+		setLoc(prevs[0].GeoPoint)
+	}
+
+	return gaps, false, nil
+}
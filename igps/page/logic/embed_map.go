@@ -0,0 +1,77 @@
+/*
+EmbedMap page logic: an interactive map rendered from the tiles of the configured map provider,
+used as the embedded map and view map of tile based map providers.
+
+Maps are displayed using the Leaflet JavaScript library: http://leafletjs.com/
+*/
+
+package logic
+
+import (
+	"html/template"
+	"igps/maps"
+	"igps/page"
+	"strconv"
+)
+
+func init() {
+	page.NamePageMap["EmbedMap"].Logic = embedMap
+}
+
+// Template of the EmbedMap page.
+var embedMapTempl = template.Must(template.New("embedMap").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Center}}</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.0.3/dist/leaflet.css" />
+<script src="https://unpkg.com/leaflet@1.0.3/dist/leaflet.js"></script>
+<style>html, body, #map { width: 100%; height: 100%; margin: 0; }</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+var map = L.map("map").setView([{{.Lat}}, {{.Lng}}], {{.Zoom}});
+L.tileLayer({{.TileURL}}, { attribution: {{.Attribution}}, maxZoom: 19 }).addTo(map);
+L.marker([{{.Lat}}, {{.Lng}}]).addTo(map);
+</script>
+</body>
+</html>
+`))
+
+// embedMap is the logic implementation of the EmbedMap page.
+//
+// Form parameters: "center" is the location to display in "lat,lng" format, and the optional "zoom" level.
+func embedMap(p *page.Params) {
+	prov := maps.Current()
+	if prov.TileURL() == "" {
+		p.ErrorMsg = template.HTML("The configured map provider does not serve tiles!")
+		return
+	}
+
+	gp, ok := parseLatLng(p.Request.FormValue("center"))
+	if !ok {
+		p.ErrorMsg = template.HTML(`Invalid <span class="highlight">center</span>!`)
+		return
+	}
+
+	zoom := 16
+	if s := p.Request.FormValue("zoom"); s != "" {
+		var err error
+		if zoom, err = strconv.Atoi(s); err != nil || zoom < 1 || zoom > 20 {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">zoom</span>! Valid range: 1..20`)
+			return
+		}
+	}
+
+	w := p.ResponseWriter
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	p.Err = embedMapTempl.Execute(w, map[string]interface{}{
+		"Center":      maps.Center(gp.Lat, gp.Lng),
+		"Lat":         gp.Lat,
+		"Lng":         gp.Lng,
+		"Zoom":        zoom,
+		"TileURL":     prov.TileURL(),
+		"Attribution": prov.Attribution(),
+	})
+}
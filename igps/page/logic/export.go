@@ -0,0 +1,135 @@
+/*
+Export page logic: exports GPS records of a Device to files.
+*/
+
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"io"
+	"regexp"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Export"].Logic = export
+}
+
+// Max number of GPS records in an export.
+const maxExportRecords = 10000
+
+// exportFormat describes a file format GPS records can be exported to.
+type exportFormat struct {
+	// Name of the format, value of the "format" form parameter.
+	Name string
+
+	// File extension of exported files.
+	Ext string
+
+	// Content type of exported files.
+	ContentType string
+
+	// write writes the export data in this format.
+	write func(w io.Writer, x *exportData) error
+}
+
+// Supported export formats.
+var exportFormats = []*exportFormat{
+	{"gpx", "gpx", "application/gpx+xml", writeGPX},
+	{"kml", "kml", "application/vnd.google-earth.kml+xml", writeKML},
+	{"kmz", "kmz", "application/vnd.google-earth.kmz", writeKMZ},
+}
+
+// exportData is the data to be exported.
+type exportData struct {
+	// Device whose records are exported.
+	Dev *ds.Device
+
+	// Records to export, in chronological order, simplified if requested, metrics calculated.
+	Records []*ds.GPS
+
+	// Nearest localities of the records (see recordNears()).
+	Nears map[*ds.GPS]*geoResult
+
+	// Tells if there were more records than maxExportRecords (only the latest are exported).
+	Truncated bool
+
+	// Time of the export.
+	Created time.Time
+}
+
+// export is the logic implementation of the Export page.
+//
+// Form parameters: "format" (see exportFormats), "devID", the optional "before" and "after" time filters
+// (same as on the Logs page) and the optional "simplify" which is the tolerance in meters to simplify
+// trips with (see simplifyTrack()), e.g.
+//
+//	/export?format=gpx&devID=123&after=15-03-01%2000:00:00&simplify=10
+func export(p *page.Params) {
+	c := p.AppCtx
+	fv := p.Request.FormValue
+
+	var format *exportFormat
+	for _, f := range exportFormats {
+		if f.Name == fv("format") {
+			format = f
+			break
+		}
+	}
+	if format == nil {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">format</span>: {{.}}`, fv("format"))
+		return
+	}
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		return
+	}
+
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		return
+	}
+
+	tolerance, ok := parseSimplifyTolerance(p)
+	if !ok {
+		return
+	}
+
+	x := exportData{Dev: dev, Created: time.Now()}
+	if x.Records, x.Truncated, p.Err = loadRecords(c, dev.KeyID, before, after, -1, maxExportRecords); p.Err != nil {
+		return
+	}
+	x.Records = simplifyRecords(x.Records, tolerance)
+	calcMetrics(x.Records)
+	x.Nears = recordNears(c, x.Records)
+
+	// Write into a buffer first, so in case of an error we can still serve the Internal Error page.
+	buf := &bytes.Buffer{}
+	if p.Err = format.write(buf, &x); p.Err != nil {
+		return
+	}
+
+	w := p.ResponseWriter
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(dev, x.Created, format)))
+	if _, err := buf.WriteTo(w); err != nil {
+		c.Warningf("Failed to write export response: %v", err)
+	}
+}
+
+// Regexp matching characters not allowed in exported file names.
+var fileNameInvalidRegexp = regexp.MustCompile(`[^\w\-]+`)
+
+// exportFileName returns the file name of an export of the specified device.
+func exportFileName(dev *ds.Device, t time.Time, format *exportFormat) string {
+	return fmt.Sprintf("%s-%s.%s", fileNameInvalidRegexp.ReplaceAllString(dev.Name, "_"), t.Format("20060102-150405"), format.Ext)
+}
@@ -0,0 +1,218 @@
+/*
+Offline reverse geocoding: resolves the nearest locality of a location from a gazetteer file.
+
+The gazetteer is a GeoNames cities file (e.g. cities15000.txt from http://download.geonames.org/export/dump/),
+tab-separated, one locality per line, using the following columns:
+    1: geonameid, 2: name, 5: latitude, 6: longitude, 9: country code
+The path of the file is specified by the GAZETTEER_FILE environment variable (see app.yaml).
+If the file does not exist, reverse geocoding is disabled.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"bufio"
+	"fmt"
+	"igps/ds"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Name of the environment variable specifying the path of the gazetteer file.
+const gazetteerEnvVar = "GAZETTEER_FILE"
+
+// Localities farther than this many grid cells (degrees) are not searched.
+const geocodeMaxRing = 3
+
+// Area size in meters of the cells reverse geocoding results are cached for (see AreaCodeForGeoPt()).
+const geocodeAreaSize = 1000
+
+// Max number of cached reverse geocoding results, the cache is cleared if reached.
+const geocodeMaxCached = 100 * 1000
+
+// locality is a populated place of the gazetteer.
+type locality struct {
+	Name    string
+	Country string // ISO-3166 2-letter country code
+	Lat     float64
+	Lng     float64
+}
+
+// geoResult is the result of reverse geocoding: the nearest locality and the distance from it.
+type geoResult struct {
+	Locality *locality
+
+	// Distance from the locality in meters
+	Dist int64
+}
+
+// String returns the result in a human readable format, e.g. "Budapest, HU (3.2 km)".
+func (g *geoResult) String() string {
+	return fmt.Sprintf("%s, %s (%.1f km)", g.Locality.Name, g.Locality.Country, float64(g.Dist)/1000)
+}
+
+// gridCell identifies a 1x1 degree cell of the spatial index.
+type gridCell struct {
+	lat, lng int
+}
+
+// cellOf returns the grid cell of the specified location.
+func cellOf(lat, lng float64) gridCell {
+	return gridCell{int(math.Floor(lat)), int(math.Floor(lng))}
+}
+
+var (
+	// Spatial index of the localities: localities grouped by grid cells
+	gazetteer map[gridCell][]*locality
+
+	// Used to load the gazetteer only once, on first use
+	gazetteerOnce sync.Once
+)
+
+// loadGazetteer loads the gazetteer file into the spatial index.
+func loadGazetteer(c appengine.Context) {
+	path := os.Getenv(gazetteerEnvVar)
+	if path == "" {
+		c.Infof("%s is not set, reverse geocoding is disabled.", gazetteerEnvVar)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		c.Warningf("Failed to open gazetteer, reverse geocoding is disabled: %v", err)
+		return
+	}
+	defer f.Close()
+
+	g := make(map[gridCell][]*locality)
+	count := 0
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024) // Alternate names may be long
+	for s.Scan() {
+		cols := strings.Split(s.Text(), "\t")
+		if len(cols) < 9 {
+			continue
+		}
+		l := &locality{Name: cols[1], Country: cols[8]}
+		if l.Lat, err = strconv.ParseFloat(cols[4], 64); err != nil {
+			continue
+		}
+		if l.Lng, err = strconv.ParseFloat(cols[5], 64); err != nil {
+			continue
+		}
+		cell := cellOf(l.Lat, l.Lng)
+		g[cell] = append(g[cell], l)
+		count++
+	}
+	if err = s.Err(); err != nil {
+		c.Warningf("Failed to read gazetteer, reverse geocoding is disabled: %v", err)
+		return
+	}
+
+	c.Infof("Loaded %d localities from gazetteer %s", count, path)
+	gazetteer = g
+}
+
+var (
+	// Cache of reverse geocoding results: nearest localities mapped from Area codes
+	// (nil values mean no locality nearby).
+	areaCodeLocalityMap = make(map[int64]*locality)
+
+	// Mutex used to synchronize access to the areaCodeLocalityMap.
+	areaCodeLocalityMutex sync.Mutex
+)
+
+// reverseGeocode returns the nearest locality of the specified location and the distance from it.
+// Results are cached per Area (see AreaCodeForGeoPt()), so the returned locality is the nearest one
+// to the first location looked up in the Area.
+//
+// Returns nil if reverse geocoding is disabled or there is no locality nearby.
+func reverseGeocode(c appengine.Context, lat, lng float64) *geoResult {
+	gazetteerOnce.Do(func() { loadGazetteer(c) })
+	if gazetteer == nil {
+		return nil
+	}
+
+	areaCode := AreaCodeForGeoPt(geocodeAreaSize, lat, lng)
+
+	// Synchronize access because the cache-map is shared!
+	areaCodeLocalityMutex.Lock()
+	l, ok := areaCodeLocalityMap[areaCode]
+	areaCodeLocalityMutex.Unlock()
+
+	if !ok {
+		l = nearestLocality(lat, lng)
+
+		areaCodeLocalityMutex.Lock()
+		if len(areaCodeLocalityMap) >= geocodeMaxCached {
+			areaCodeLocalityMap = make(map[int64]*locality)
+		}
+		areaCodeLocalityMap[areaCode] = l
+		areaCodeLocalityMutex.Unlock()
+	}
+
+	if l == nil {
+		return nil
+	}
+	return &geoResult{Locality: l, Dist: Distance(lat, lng, l.Lat, l.Lng)}
+}
+
+// nearestLocality returns the nearest locality of the specified location from the gazetteer,
+// or nil if there is no locality within geocodeMaxRing grid cells.
+//
+// Grid cells are searched in rings around the cell of the location. The search stops
+// when a locality is found which is closer than any locality of the next ring could be.
+func nearestLocality(lat, lng float64) (nearest *locality) {
+	var minDist int64
+	c := cellOf(lat, lng)
+
+	for ring := 0; ring <= geocodeMaxRing; ring++ {
+		for dLat := -ring; dLat <= ring; dLat++ {
+			for dLng := -ring; dLng <= ring; dLng++ {
+				if dLat != -ring && dLat != ring && dLng != -ring && dLng != ring {
+					continue // Inner cell, already searched
+				}
+				for _, l := range gazetteer[gridCell{c.lat + dLat, c.lng + dLng}] {
+					if d := Distance(lat, lng, l.Lat, l.Lng); nearest == nil || d < minDist {
+						nearest, minDist = l, d
+					}
+				}
+			}
+		}
+
+		// Localities of the next ring are at least ring degrees away
+		// (a degree of longitude is the shortest in the direction of the pole).
+		if nearest != nil {
+			minLat := math.Min(math.Abs(lat)+float64(ring), 90)
+			if float64(minDist) <= distFromGr(minLat, float64(ring)) {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// recordNears reverse geocodes the specified records (must be in chronological order),
+// and returns the results mapped from the records (records with no result are not included).
+// Locations of events are determined by evtGeoPoint().
+func recordNears(c appengine.Context, records []*ds.GPS) map[*ds.GPS]*geoResult {
+	nears := make(map[*ds.GPS]*geoResult)
+	for i, r := range records {
+		gp, ok := r.GeoPoint, r.Track()
+		if !ok {
+			gp, ok = evtGeoPoint(records, i)
+		}
+		if !ok {
+			continue
+		}
+		if g := reverseGeocode(c, gp.Lat, gp.Lng); g != nil {
+			nears[r] = g
+		}
+	}
+	return nears
+}
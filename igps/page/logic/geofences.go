@@ -0,0 +1,313 @@
+/*
+Geofences page logic, and geofence geometry.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"igps/cache"
+	"igps/ds"
+	"igps/maps"
+	"igps/page"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Geofences"].Logic = geofences
+}
+
+// Max number of vertices of a polygon geofence.
+const maxGeofencePoints = 50
+
+// Max number of recent boundary crossings listed on the Geofences page.
+const maxGeofenceCrossings = 20
+
+// geofences is the logic implementation of the Geofences page.
+func geofences(p *page.Params) {
+	c := p.AppCtx
+	fv := p.Request.PostFormValue
+	accKey := p.Account.GetKey(c)
+
+	// Initial values:
+	p.Custom["Shape"] = ds.ShapeCircle
+	p.Custom["Radius"] = 100
+
+	var geofences []*ds.Geofence
+	if geofences, p.Err = cache.GetGeofenceListForAccKey(c, accKey); p.Err != nil {
+		return
+	}
+
+	// Detect form submits:
+	switch {
+	case fv("submitSave") != "":
+		// Add / Edit Geofence form submitted!
+		var gfID int64
+		if fv("geofenceID") != "" {
+			var err error
+			if gfID, err = strconv.ParseInt(fv("geofenceID"), 10, 64); err != nil || geofenceByID(geofences, gfID) == nil {
+				p.ErrorMsg = "You do not have access to the specified Geofence!"
+				break
+			}
+		}
+		gf := ds.Geofence{Name: strings.TrimSpace(fv("name")), Shape: fv("shape"), Created: time.Now()}
+		// Checks:
+		switch {
+		case !checkName(p, fv("name")):
+		case !checkGeofenceNameUnique(p, geofences, fv("name"), gfID):
+		case gf.Shape == ds.ShapeCircle:
+			if checkPlaceLoc(p, fv("loc"), &gf.GeoPoint) && checkPlaceRadius(p, fv("radius")) {
+				gf.Radius, _ = strconv.ParseInt(fv("radius"), 10, 64)
+			}
+		case gf.Shape == ds.ShapePolygon:
+			gf.Points, _ = checkGeofencePoints(p, fv("points"))
+		default:
+			p.ErrorMsg = "Invalid Shape! Please select a Shape from the list."
+		}
+		if p.ErrorMsg == nil {
+			// All data OK, save Geofence
+			key := datastore.NewIncompleteKey(c, ds.ENameGeofence, accKey)
+			if gfID != 0 {
+				key = datastore.NewKey(c, ds.ENameGeofence, "", gfID, accKey)
+				gf.Created = geofenceByID(geofences, gfID).Created
+			}
+			if _, p.Err = datastore.Put(c, key, &gf); p.Err != nil {
+				return // Datastore error
+			}
+			p.InfoMsg = "Geofence saved successfully."
+			// Clear from memcache:
+			cache.ClearGeofenceListForAccKey(c, accKey)
+		} else {
+			// Submitted values
+			p.Custom["GeofenceID"] = fv("geofenceID")
+			p.Custom["Name"] = fv("name")
+			p.Custom["Shape"] = fv("shape")
+			p.Custom["Loc"] = fv("loc")
+			p.Custom["Radius"] = fv("radius")
+			p.Custom["Points"] = fv("points")
+		}
+	case fv("submitDelete") != "":
+		// Delete Geofence form submitted!
+		gfID, err := strconv.ParseInt(fv("geofenceID"), 10, 64)
+		if err != nil || geofenceByID(geofences, gfID) == nil {
+			p.ErrorMsg = "You do not have access to the specified Geofence!"
+			break
+		}
+		// Geofences watched by alerts cannot be deleted
+		var alerts []*ds.Alert
+		if _, p.Err = datastore.NewQuery(ds.ENameAlert).Ancestor(accKey).GetAll(c, &alerts); p.Err != nil {
+			return
+		}
+		for _, a := range alerts {
+			if a.GetType() == ds.RuleGeofence && a.Param("geofence") == gfID {
+				p.ErrorMsg = SExecTempl(`The Geofence is watched by Alerts! Delete them first on the {{.}} page.`, page.NamePageMap["Alerts"].Link())
+				break
+			}
+		}
+		if p.ErrorMsg != nil {
+			break
+		}
+		if p.Err = datastore.Delete(c, datastore.NewKey(c, ds.ENameGeofence, "", gfID, accKey)); p.Err != nil {
+			return // Datastore error
+		}
+		p.InfoMsg = "Geofence deleted successfully."
+		// Clear from memcache:
+		cache.ClearGeofenceListForAccKey(c, accKey)
+	}
+
+	if p.InfoMsg != nil {
+		// Geofences changed, reload them (ancestor queries are strongly consistent).
+		if geofences, p.Err = cache.GetGeofenceListForAccKey(c, accKey); p.Err != nil {
+			return
+		}
+	}
+
+	// Polygon vertices in the format of the Points form field, for editing
+	pointTexts := make(map[int64]string, len(geofences))
+	for _, gf := range geofences {
+		if !gf.Circle() {
+			pointTexts[gf.KeyID] = formatGeofencePoints(gf.Points)
+		}
+	}
+
+	p.Custom["Geofences"] = geofences
+	p.Custom["PointTexts"] = pointTexts
+	p.Custom["MaxPoints"] = maxGeofencePoints
+
+	// Recent boundary crossings
+	var crossings []*ds.GeofenceEvent
+	q := datastore.NewQuery(ds.ENameGeofenceEvent).Ancestor(accKey).Order("-" + ds.PNameCreated).Limit(maxGeofenceCrossings)
+	if _, p.Err = q.GetAll(c, &crossings); p.Err != nil {
+		return
+	}
+	if len(crossings) > 0 {
+		var devices []*ds.Device
+		if devices, p.Err = cache.GetDevListForAccKey(c, accKey); p.Err != nil {
+			return
+		}
+		devNames := make(map[int64]string, len(devices))
+		for _, d := range devices {
+			devNames[d.KeyID] = d.Name
+		}
+		gfNames := geofenceNames(geofences)
+		for _, e := range crossings {
+			e.DevName, e.GeofenceName = devNames[e.DevKeyID], gfNames[e.GeofenceID]
+		}
+	}
+	p.Custom["Crossings"] = crossings
+}
+
+// checkGeofenceNameUnique checks if the specified Geofence name is unique (case-insensitive) among the geofences
+// (except the Geofence with the specified ID), and sets an appropriate error message if not.
+// Returns true if is acceptable (unique).
+func checkGeofenceNameUnique(p *page.Params, geofences []*ds.Geofence, name string, gfID int64) (ok bool) {
+	name = strings.TrimSpace(name)
+	for _, gf := range geofences {
+		if strings.EqualFold(gf.Name, name) && gf.KeyID != gfID {
+			p.ErrorMsg = SExecTempl(`You already have a Geofence named <span class="highlight">{{.}}</span>!`, gf.Name)
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkGeofencePoints checks the specified polygon vertices (one "lat,lng" location per line)
+// and sets an appropriate error message if there's something wrong with them.
+// Returns the parsed vertices and true if they are acceptable (valid).
+func checkGeofencePoints(p *page.Params, points string) (gps []appengine.GeoPoint, ok bool) {
+	for i, line := range strings.Split(points, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		gp, valid := parseLatLng(line)
+		if !valid {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="code">Points</span> in line {{.}}! Format: "latitude,longitude" in range [-90, 90] latitude and [-180, 180] longitude`, i+1)
+			return nil, false
+		}
+		gps = append(gps, gp)
+	}
+	if len(gps) < 3 || len(gps) > maxGeofencePoints {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="code">Points</span>! A polygon must have 3..{{.}} points.`, maxGeofencePoints)
+		return nil, false
+	}
+
+	return gps, true
+}
+
+// formatGeofencePoints formats the specified polygon vertices, one "lat,lng" location per line.
+func formatGeofencePoints(gps []appengine.GeoPoint) string {
+	lines := make([]string, len(gps))
+	for i, gp := range gps {
+		lines[i] = fmt.Sprint(gp.Lat, ",", gp.Lng)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// geofenceByID returns the Geofence with the specified ID from geofences, or nil if not found.
+func geofenceByID(geofences []*ds.Geofence, gfID int64) *ds.Geofence {
+	for _, gf := range geofences {
+		if gf.KeyID == gfID {
+			return gf
+		}
+	}
+	return nil
+}
+
+// geofenceNames returns the names of the specified geofences mapped from their IDs.
+func geofenceNames(geofences []*ds.Geofence) map[int64]string {
+	names := make(map[int64]string, len(geofences))
+	for _, gf := range geofences {
+		names[gf.KeyID] = gf.Name
+	}
+	return names
+}
+
+// GeofenceContains tells if the specified location is inside the specified geofence.
+//
+// Calculations are done on an equirectangular projection with the latitude of the location,
+// accurate enough for geofences not larger than a few hundred kilometers. Polygons are tested with
+// the ray casting algorithm.
+func GeofenceContains(gf *ds.Geofence, gp appengine.GeoPoint) bool {
+	// Coordinates relative to the location in meters, the location being the origin.
+	// Unlike Distance(), the same latitude is used for all East-West distances, so they are not distorted
+	// by the distance from Greenwich.
+	xy := func(p appengine.GeoPoint) (x, y float64) {
+		return distFromGr(gp.Lat, p.Lng) - distFromGr(gp.Lat, gp.Lng), distFromEq(p.Lat) - distFromEq(gp.Lat)
+	}
+
+	if gf.Circle() {
+		x, y := xy(gf.GeoPoint)
+		return math.Hypot(x, y) <= float64(gf.Radius)
+	}
+
+	// Count crossings of the edges with the ray pointing to the East
+	inside := false
+	for i, j := 0, len(gf.Points)-1; i < len(gf.Points); j, i = i, i+1 {
+		xi, yi := xy(gf.Points[i])
+		xj, yj := xy(gf.Points[j])
+		if (yi > 0) != (yj > 0) && xi+(xj-xi)*(0-yi)/(yj-yi) > 0 {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Number of vertices circle geofences are approximated with when drawn as polygons.
+const circleOutlinePoints = 36
+
+// geofenceOutline returns the closed outline of the specified geofence: the vertices of the polygon
+// (circles approximated by a regular polygon), the first vertex repeated at the end.
+func geofenceOutline(gf *ds.Geofence) []maps.LatLng {
+	if !gf.Circle() {
+		pts := make([]maps.LatLng, len(gf.Points), len(gf.Points)+1)
+		for i, gp := range gf.Points {
+			pts[i] = maps.LatLng{Lat: gp.Lat, Lng: gp.Lng}
+		}
+		return append(pts, pts[0])
+	}
+
+	lat, lng := gf.GeoPoint.Lat, gf.GeoPoint.Lng
+	// Degrees per meter in North and East directions
+	dLat := 1 / distFromEq(1)
+	dLng := 1 / distFromGr(lat, 1)
+	pts := make([]maps.LatLng, circleOutlinePoints+1)
+	for i := range pts {
+		a := 2 * math.Pi * float64(i%circleOutlinePoints) / circleOutlinePoints
+		r := float64(gf.Radius)
+		pts[i] = maps.LatLng{Lat: lat + r*math.Cos(a)*dLat, Lng: lng + r*math.Sin(a)*dLng}
+	}
+	return pts
+}
+
+// Color of geofences on maps, in "#rrggbb" format.
+const clrGeofence = "#9400d3"
+
+// geofencesNear returns the geofences whose outline overlaps the bounding box of the Track records
+// of the specified records.
+func geofencesNear(geofences []*ds.Geofence, records []*ds.GPS) (near []*ds.Geofence) {
+	minLat, maxLat, minLng, maxLng := 90.0, -90.0, 180.0, -180.0
+	for _, r := range records {
+		if r.Track() {
+			minLat, maxLat = math.Min(minLat, r.GeoPoint.Lat), math.Max(maxLat, r.GeoPoint.Lat)
+			minLng, maxLng = math.Min(minLng, r.GeoPoint.Lng), math.Max(maxLng, r.GeoPoint.Lng)
+		}
+	}
+
+	for _, gf := range geofences {
+		gMinLat, gMaxLat, gMinLng, gMaxLng := 90.0, -90.0, 180.0, -180.0
+		for _, pt := range geofenceOutline(gf) {
+			gMinLat, gMaxLat = math.Min(gMinLat, pt.Lat), math.Max(gMaxLat, pt.Lat)
+			gMinLng, gMaxLng = math.Min(gMinLng, pt.Lng), math.Max(gMaxLng, pt.Lng)
+		}
+		if gMinLat <= maxLat && gMaxLat >= minLat && gMinLng <= maxLng && gMaxLng >= minLng {
+			near = append(near, gf)
+		}
+	}
+	return
+}
@@ -0,0 +1,278 @@
+/*
+GeoJSON page logic: a GeoJSON feed of the GPS records of a Device.
+
+GeoJSON specification: http://geojson.org/geojson-spec.html
+*/
+
+package logic
+
+import (
+	"appengine/datastore"
+	"encoding/json"
+	"fmt"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["GeoJSON"].Logic = geoJSON
+}
+
+// Default and max number of GPS records in a GeoJSON page.
+const (
+	geoJSONDefLimit = 100
+	geoJSONMaxLimit = 1000
+)
+
+// geoJSONFC is a GeoJSON FeatureCollection.
+type geoJSONFC struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+
+	// Cursor of the next page, empty if this is the last page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// geoJSONFeature is a GeoJSON Feature.
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// geoJSONGeometry is a GeoJSON Point or LineString geometry.
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// geoJSON is the logic implementation of the GeoJSON page.
+//
+// It requires a logged in user with an Account or an API token (see the Settings page)
+// provided in the "token" form parameter or in an "Authorization: Bearer <token>" HTTP header.
+//
+// Form parameters: "devID", the optional "before" and "after" time filters (same as on the Logs page),
+// the optional "limit" (max number of records, default is 100, max is 1000),
+// the optional "simplify" (tolerance in meters to simplify trips with, see simplifyTrack())
+// and the optional "cursor" which is the cursor of the page to return (returned in the previous page).
+//
+// Response is a FeatureCollection containing a LineString for each trip and a Point for each event
+// of the requested page of records (pages are in reverse chronological order, features in a page are chronological).
+func geoJSON(p *page.Params) {
+	c := p.AppCtx
+	w := p.ResponseWriter
+	fv := p.Request.FormValue
+
+	// Allow usage from other sites (e.g. dashboards), authentication is done with API tokens.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if p.Request.Method == "OPTIONS" {
+		// Preflight request
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		return
+	}
+
+	if token := apiToken(p.Request); token != "" {
+		var acc *ds.Account
+		if acc, p.Err = cache.GetAccountForAPIToken(c, token); p.Err != nil {
+			return
+		}
+		if acc == nil {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API token!")
+			return
+		}
+		p.Account = acc
+	}
+	if p.Account == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Login or API token required!")
+		return
+	}
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		writeJSONErrorMsg(p)
+		return
+	}
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		writeJSONErrorMsg(p)
+		return
+	}
+
+	tolerance, ok := parseSimplifyTolerance(p)
+	if !ok {
+		writeJSONErrorMsg(p)
+		return
+	}
+
+	limit := geoJSONDefLimit
+	if fv("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(fv("limit")); err != nil || limit < 1 || limit > geoJSONMaxLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit! Valid range: 1..%d", geoJSONMaxLimit))
+			return
+		}
+	}
+
+	q := datastore.NewQuery(ds.ENameGPS).Filter(ds.PNameDevKeyID+"=", dev.KeyID)
+	if !before.IsZero() {
+		q = q.Filter(ds.PNameCreated+"<", before)
+	}
+	if !after.IsZero() {
+		q = q.Filter(ds.PNameCreated+">", after)
+	}
+	q = q.Order("-" + ds.PNameCreated).Limit(limit)
+	if fv("cursor") != "" {
+		cursor, err := datastore.DecodeCursor(fv("cursor"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid cursor!")
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var records = make([]*ds.GPS, 0, limit)
+	t := q.Run(c)
+	for {
+		r := new(ds.GPS)
+		_, err := t.Next(r)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			// Datastore error
+			p.Err = err
+			return
+		}
+		records = append(records, r)
+	}
+
+	fc := geoJSONFC{Type: "FeatureCollection", Features: []*geoJSONFeature{}}
+
+	if len(records) == limit {
+		// There might be more records
+		var cursor datastore.Cursor
+		if cursor, p.Err = t.Cursor(); p.Err != nil {
+			return
+		}
+		fc.Cursor = cursor.String()
+	}
+
+	// Reverse to chronological order
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	records = simplifyRecords(records, tolerance)
+	calcMetrics(records)
+	nears := recordNears(c, records)
+
+	loc := p.Account.Location()
+	fmtTime := func(t time.Time) string {
+		return t.In(loc).Format(time.RFC3339)
+	}
+
+	for _, trip := range splitTrips(records) {
+		coords := make([][2]float64, len(trip))
+		times := make([]string, len(trip))
+		// Metrics: null if not available
+		dds, dts, vs := make([]interface{}, len(trip)), make([]interface{}, len(trip)), make([]interface{}, len(trip))
+		for i, r := range trip {
+			coords[i] = [2]float64{r.GeoPoint.Lng, r.GeoPoint.Lat}
+			times[i] = fmtTime(r.Created)
+			if r.Metrics() {
+				dds[i], dts[i] = r.Dd, r.DtString()
+				if r.Dt > 0 {
+					// Speed in km/h (same as GPS.V()); records with the same timestamp have no speed
+					vs[i] = float64(r.Dd) / r.Dt.Hours() / 1000
+				}
+			}
+		}
+		f := &geoJSONFeature{
+			Type:     "Feature",
+			Geometry: &geoJSONGeometry{"LineString", coords},
+			Properties: map[string]interface{}{
+				"kind":   "trip",
+				"device": dev.Name,
+				"start":  times[0],
+				"end":    times[len(times)-1],
+				"times":  times, // Timestamps of the coordinates
+				"dd":     dds,   // Delta distances [m]
+				"dt":     dts,   // Delta times [s]
+				"v":      vs,    // Speeds [km/h]
+			},
+		}
+		if near := nears[trip[0]]; near != nil {
+			f.Properties["startNear"] = near.String()
+		}
+		if near := nears[trip[len(trip)-1]]; near != nil {
+			f.Properties["endNear"] = near.String()
+		}
+		fc.Features = append(fc.Features, f)
+	}
+
+	for i, r := range records {
+		if r.Track() {
+			continue
+		}
+		f := &geoJSONFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"kind":   "event",
+				"device": dev.Name,
+				"event":  r.Evt().String(),
+				"time":   fmtTime(r.Created),
+			},
+		}
+		if gp, ok := evtGeoPoint(records, i); ok {
+			f.Geometry = &geoJSONGeometry{"Point", [2]float64{gp.Lng, gp.Lat}}
+		}
+		if near := nears[r]; near != nil {
+			f.Properties["near"] = near.String()
+		}
+		fc.Features = append(fc.Features, f)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.geo+json")
+	if err := json.NewEncoder(w).Encode(&fc); err != nil {
+		c.Warningf("Failed to write GeoJSON response: %v", err)
+	}
+}
+
+// apiToken returns the API token provided in the "token" form parameter
+// or in an "Authorization: Bearer <token>" HTTP header.
+func apiToken(r *http.Request) string {
+	if token := r.FormValue("token"); token != "" {
+		return token
+	}
+	const prefix = "Bearer "
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// writeJSONError writes an error response in JSON format.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// Regexp matching HTML tags.
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// writeJSONErrorMsg writes the error message set by checks in JSON format (stripped from HTML tags),
+// and clears the error message so no page will be rendered.
+func writeJSONErrorMsg(p *page.Params) {
+	writeJSONError(p.ResponseWriter, http.StatusBadRequest, htmlTagRegexp.ReplaceAllString(fmt.Sprint(p.ErrorMsg), ""))
+	p.ErrorMsg = nil
+}
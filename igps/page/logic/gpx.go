@@ -0,0 +1,128 @@
+/*
+GPX 1.1 export of GPS records.
+
+GPX 1.1 schema documentation: http://www.topografix.com/GPX/1/1/
+*/
+
+package logic
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// gpx is the root element of a GPX 1.1 document.
+type gpx struct {
+	XMLName        xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version        string   `xml:"version,attr"`
+	Creator        string   `xml:"creator,attr"`
+	XmlnsXsi       string   `xml:"xmlns:xsi,attr"`
+	XmlnsGpxtpx    string   `xml:"xmlns:gpxtpx,attr"`
+	SchemaLocation string   `xml:"xsi:schemaLocation,attr"`
+
+	Metadata gpxMetadata `xml:"metadata"`
+	Wpts     []*gpxWpt   `xml:"wpt"`
+	Trk      gpxTrk      `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name"`
+	Desc string `xml:"desc,omitempty"`
+	Time string `xml:"time"`
+}
+
+// gpxWpt is a waypoint (wptType), also used as track points.
+type gpxWpt struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+	Type string  `xml:"type,omitempty"`
+
+	Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+type gpxTrk struct {
+	Name    string       `xml:"name"`
+	Trksegs []*gpxTrkseg `xml:"trkseg"`
+}
+
+type gpxTrkseg struct {
+	Trkpts []*gpxWpt `xml:"trkpt"`
+}
+
+// gpxExtensions holds the extra data of track points.
+// The standard Garmin TrackPointExtension is used which is understood by most applications.
+type gpxExtensions struct {
+	TrackPointExtension struct {
+		// Speed in m/s
+		Speed string `xml:"gpxtpx:speed"`
+	} `xml:"gpxtpx:TrackPointExtension"`
+}
+
+// gpxTime formats the specified time as required by GPX (UTC, xsd:dateTime).
+func gpxTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeGPX writes the export data in GPX 1.1 format.
+//
+// Each trip (Start-Stop span, see splitTrips()) is written as a separate track segment,
+// events are written as waypoints.
+func writeGPX(w io.Writer, x *exportData) error {
+	g := gpx{
+		Version:        "1.1",
+		Creator:        "IczaGPS - https://iczagps.appspot.com/",
+		XmlnsXsi:       "http://www.w3.org/2001/XMLSchema-instance",
+		XmlnsGpxtpx:    "http://www.garmin.com/xmlschemas/TrackPointExtension/v2",
+		SchemaLocation: "http://www.topografix.com/GPX/1/1 http://www.topografix.com/GPX/1/1/gpx.xsd http://www.garmin.com/xmlschemas/TrackPointExtension/v2 http://www8.garmin.com/xmlschemas/TrackPointExtensionv2.xsd",
+		Metadata:       gpxMetadata{Name: x.Dev.Name, Time: gpxTime(x.Created)},
+		Trk:            gpxTrk{Name: x.Dev.Name},
+	}
+	if x.Truncated {
+		g.Metadata.Desc = fmt.Sprintf("Only the latest %d records are exported.", maxExportRecords)
+	}
+
+	// Waypoints for events
+	for i, r := range x.Records {
+		if r.Track() {
+			continue
+		}
+		gp, ok := evtGeoPoint(x.Records, i)
+		if !ok {
+			continue
+		}
+		wpt := &gpxWpt{Lat: gp.Lat, Lon: gp.Lng, Time: gpxTime(r.Created), Name: r.Evt().String(), Type: r.Evt().String()}
+		if near := x.Nears[r]; near != nil {
+			wpt.Desc = near.String()
+		}
+		g.Wpts = append(g.Wpts, wpt)
+	}
+
+	// Track segments for trips
+	for _, trip := range splitTrips(x.Records) {
+		seg := &gpxTrkseg{Trkpts: make([]*gpxWpt, len(trip))}
+		for i, r := range trip {
+			pt := &gpxWpt{Lat: r.GeoPoint.Lat, Lon: r.GeoPoint.Lng, Time: gpxTime(r.Created)}
+			if near := x.Nears[r]; near != nil {
+				pt.Desc = near.String()
+			}
+			if r.Metrics() && r.Dt > 0 {
+				pt.Extensions = new(gpxExtensions)
+				pt.Extensions.TrackPointExtension.Speed = fmt.Sprintf("%.2f", float64(r.Dd)/r.Dt.Seconds())
+			}
+			seg.Trkpts[i] = pt
+		}
+		g.Trk.Trksegs = append(g.Trk.Trksegs, seg)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(&g)
+}
@@ -0,0 +1,204 @@
+/*
+KML and KMZ export of GPS records, for playback in Google Earth.
+
+KML documentation: https://developers.google.com/kml/documentation/kmlreference
+*/
+
+package logic
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"igps/ds"
+	"io"
+	"time"
+)
+
+// KML colors of the map colors (format: aabbggrr).
+var kmlColors = map[string]string{
+	clrTrack:      "ffff0000",
+	clrAfterStart: "ff00b000",
+	clrBeforeStop: "ff0000ff",
+	clrGeofence:   "ffd30094",
+}
+
+// kml is the root element of a KML document.
+type kml struct {
+	XMLName xml.Name `xml:"http://www.opengis.net/kml/2.2 kml"`
+	XmlnsGx string   `xml:"xmlns:gx,attr"`
+
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name        string       `xml:"name"`
+	Description string       `xml:"description,omitempty"`
+	Styles      []*kmlStyle  `xml:"Style"`
+	Folders     []*kmlFolder `xml:"Folder"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type kmlIconStyle struct {
+	Color string `xml:"color"`
+}
+
+type kmlFolder struct {
+	Name       string          `xml:"name"`
+	Placemarks []*kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description,omitempty"`
+	TimeStamp   *kmlTimeStamp `xml:"TimeStamp,omitempty"` // TimePrimitive precedes styleUrl in the KML 2.2 schema
+	StyleURL    string        `xml:"styleUrl"`
+	Point       *kmlPoint     `xml:"Point,omitempty"`
+	Track       *kmlTrack     `xml:"gx:Track,omitempty"`
+}
+
+type kmlTimeStamp struct {
+	When string `xml:"when"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// kmlTrack is a gx:Track, a time-stamped path which makes the Google Earth time slider work.
+type kmlTrack struct {
+	Whens  []string `xml:"when"`
+	Coords []string `xml:"gx:coord"`
+}
+
+// add adds the specified record to the track.
+func (t *kmlTrack) add(r *ds.GPS) {
+	t.Whens = append(t.Whens, kmlTime(r.Created))
+	t.Coords = append(t.Coords, fmt.Sprintf("%f %f 0", r.GeoPoint.Lng, r.GeoPoint.Lat))
+}
+
+// kmlTime formats the specified time as required by KML (xsd:dateTime).
+func kmlTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeKML writes the export data in KML format.
+//
+// Each trip (see splitTrips()) is written as time-stamped tracks, split into parts colored the same way
+// as markers on the Logs page map previews. Events are written as placemarks in a separate folder.
+func writeKML(w io.Writer, x *exportData) error {
+	k := kml{XmlnsGx: "http://www.google.com/kml/ext/2.2"}
+	d := &k.Document
+	d.Name = x.Dev.Name
+	if x.Truncated {
+		d.Description = fmt.Sprintf("Only the latest %d records are exported.", maxExportRecords)
+	}
+
+	for _, clr := range []string{clrTrack, clrAfterStart, clrBeforeStop} {
+		d.Styles = append(d.Styles, &kmlStyle{ID: clr, LineStyle: &kmlLineStyle{kmlColors[clr], 4}})
+	}
+	d.Styles = append(d.Styles,
+		&kmlStyle{ID: ds.EvtStart.String(), IconStyle: &kmlIconStyle{kmlColors[clrAfterStart]}},
+		&kmlStyle{ID: ds.EvtStop.String(), IconStyle: &kmlIconStyle{kmlColors[clrBeforeStop]}})
+
+	// Index of records to look up neighbours (which determine colors)
+	idxs := make(map[*ds.GPS]int, len(x.Records))
+	for i, r := range x.Records {
+		idxs[r] = i
+	}
+
+	tracks := &kmlFolder{Name: "Trips"}
+	for i, trip := range splitTrips(x.Records) {
+		// Description of the trip: nearest localities of the first and last records
+		var desc string
+		if from, to := x.Nears[trip[0]], x.Nears[trip[len(trip)-1]]; from != nil && to != nil {
+			desc = fmt.Sprintf("From %s to %s", from, to)
+		}
+		// Consecutive records with the same color form a part.
+		// A new part also includes the last record of the previous part so the path is continuous.
+		var pm *kmlPlacemark
+		var prev *ds.GPS
+		for _, r := range trip {
+			idx := idxs[r]
+			var earlier, later *ds.GPS
+			if idx > 0 {
+				earlier = x.Records[idx-1]
+			}
+			if idx < len(x.Records)-1 {
+				later = x.Records[idx+1]
+			}
+			clr := trackColor(earlier, later)
+
+			if pm == nil || pm.StyleURL != "#"+clr {
+				pm = &kmlPlacemark{Name: fmt.Sprintf("Trip %d", i+1), Description: desc, StyleURL: "#" + clr, Track: new(kmlTrack)}
+				tracks.Placemarks = append(tracks.Placemarks, pm)
+				if prev != nil {
+					pm.Track.add(prev)
+				}
+			}
+			pm.Track.add(r)
+			prev = r
+		}
+	}
+
+	events := &kmlFolder{Name: "Events"}
+	for i, r := range x.Records {
+		if r.Track() {
+			continue
+		}
+		gp, ok := evtGeoPoint(x.Records, i)
+		if !ok {
+			continue
+		}
+		pm := &kmlPlacemark{
+			Name:      r.Evt().String(),
+			StyleURL:  "#" + r.Evt().String(),
+			TimeStamp: &kmlTimeStamp{kmlTime(r.Created)},
+			Point:     &kmlPoint{fmt.Sprintf("%f,%f,0", gp.Lng, gp.Lat)},
+		}
+		if near := x.Nears[r]; near != nil {
+			pm.Description = near.String()
+		}
+		events.Placemarks = append(events.Placemarks, pm)
+	}
+
+	d.Folders = []*kmlFolder{tracks, events}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(&k)
+}
+
+// WriteRecordsKMZ writes the specified GPS records (in chronological order) of the device
+// with the specified name in KMZ format, e.g. to be attached to alert emails.
+func WriteRecordsKMZ(w io.Writer, devName string, records []*ds.GPS, t time.Time) error {
+	return writeKMZ(w, &exportData{Dev: &ds.Device{Name: devName}, Records: records, Created: t})
+}
+
+// writeKMZ writes the export data in KMZ format which is a zipped KML.
+func writeKMZ(w io.Writer, x *exportData) error {
+	z := zip.NewWriter(w)
+	fh := &zip.FileHeader{Name: "doc.kml", Method: zip.Deflate}
+	fh.SetModTime(x.Created)
+	f, err := z.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if err = writeKML(f, x); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,181 @@
+/*
+Logs JSON page logic: the records matching the Logs page filters in JSON format, used by the interactive map.
+*/
+
+package logic
+
+import (
+	"encoding/json"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+)
+
+func init() {
+	page.NamePageMap["LogsJSON"].Logic = logsJSON
+}
+
+// Max number of GPS records on the interactive map.
+const maxMapRecords = 1000
+
+// mapRecord is a GPS record as it is sent to the interactive map.
+// Fields hold the same data as the columns of the Logs table.
+type mapRecord struct {
+	// Number of the record (same as in the Logs table: latest is 1)
+	No int `json:"no"`
+
+	// Time of the record formatted in the Account's location
+	Time string `json:"time"`
+
+	// Time of the record in milliseconds since epoch, for playback
+	Millis int64 `json:"ms"`
+
+	// Elapsed time since the record
+	Ago string `json:"ago"`
+
+	// Event of the record
+	Evt string `json:"evt"`
+
+	// Location, only for Track records
+	Lat float64 `json:"lat,omitempty"`
+	Lng float64 `json:"lng,omitempty"`
+
+	// Metrics (delta distance [m], delta time [s] and speed [km/h]), only if present
+	Dd int64  `json:"dd,omitempty"`
+	Dt int64  `json:"dt,omitempty"`
+	V  string `json:"v,omitempty"`
+
+	// Marker color, only for Track records
+	Clr string `json:"clr,omitempty"`
+
+	// Name of the Place the record is at, if any
+	Place string `json:"place,omitempty"`
+
+	// Nearest locality, if any (see reverseGeocode())
+	Near string `json:"near,omitempty"`
+
+	// Name of the Device, only if records of several Devices are displayed
+	Dev string `json:"dev,omitempty"`
+
+	// Path color of the Device, only if records of several Devices are displayed
+	DevClr string `json:"dclr,omitempty"`
+}
+
+// mapGeofence is a geofence as it is sent to the interactive map.
+type mapGeofence struct {
+	// Name of the geofence
+	Name string `json:"nm"`
+
+	// Closed outline of the geofence, "[lat, lng]" pairs (see geofenceOutline())
+	Points [][2]float64 `json:"pts"`
+}
+
+// logsJSON is the logic implementation of the Logs JSON page.
+//
+// It has the same form parameters as the Logs page (devices and filters), and returns
+// the matching records of the latest maxMapRecords records (of all the devices, merged) as a JSON object in the form of
+//
+//	{"records": [...], "truncated": true/false, "geofences": [...]}
+//
+// Records are in reverse chronological order (the sort order of the Logs table is not applied).
+// All geofences of the account are included to be drawn on the map.
+func logsJSON(p *page.Params) {
+	c := p.AppCtx
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	devs := checkDevices(p, p.Request.Form["devID"], devices)
+	if devs == nil {
+		writeJSONErrorMsg(p)
+		return
+	}
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		writeJSONErrorMsg(p)
+		return
+	}
+	filter, ok := parseRecFilter(p)
+	if !ok {
+		writeJSONErrorMsg(p)
+		return
+	}
+	var places []*ds.Place
+	if places, p.Err = cache.GetPlaceListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	var geofences []*ds.Geofence
+	if geofences, p.Err = cache.GetGeofenceListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	areaCodes := make([]int64, len(devs))
+	for i, dev := range devs {
+		if areaCodes[i], ok = parseLocFilter(p, dev, places); !ok {
+			writeJSONErrorMsg(p)
+			return
+		}
+	}
+
+	var records []*ds.GPS
+	var truncated bool
+	if records, truncated, p.Err = loadMergedRecords(c, devs, before, after, areaCodes, maxMapRecords); p.Err != nil {
+		return
+	}
+	calcMetrics(records)
+	// Event and speed filters are applied in memory (speed requires metrics)
+	records = filterRecords(records, filter)
+	devClrs := devColorMap(devs)
+	clrs := trackColors(records, devClrs)
+	rps := recordPlaces(records, places)
+	nears := recordNears(c, records)
+	devNames := make(map[int64]string, len(devs))
+	for _, dev := range devs {
+		devNames[dev.KeyID] = dev.Name
+	}
+
+	mrs := make([]*mapRecord, len(records))
+	loc := p.Account.Location()
+	for i, r := range records {
+		mr := &mapRecord{
+			No:     len(records) - i,
+			Time:   r.Created.In(loc).Format(timeLayout),
+			Millis: r.Created.UnixNano() / 1e6,
+			Ago:    r.Ago().String(),
+			Evt:    r.Evt().String(),
+		}
+		if r.Track() {
+			mr.Lat, mr.Lng = r.GeoPoint.Lat, r.GeoPoint.Lng
+			mr.Clr = clrs[r]
+		}
+		if pl := rps[i]; pl != nil {
+			mr.Place = pl.Name
+		}
+		if g := nears[r]; g != nil {
+			mr.Near = g.String()
+		}
+		if r.Metrics() {
+			mr.Dd, mr.Dt, mr.V = r.Dd, r.DtString(), r.V()
+		}
+		if devClrs != nil {
+			mr.Dev, mr.DevClr = devNames[r.DevKeyID], devClrs[r.DevKeyID]
+		}
+		// Reverse chronological order:
+		mrs[len(records)-1-i] = mr
+	}
+
+	mgs := make([]*mapGeofence, len(geofences))
+	for i, gf := range geofences {
+		mg := &mapGeofence{Name: gf.Name}
+		for _, pt := range geofenceOutline(gf) {
+			mg.Points = append(mg.Points, [2]float64{pt.Lat, pt.Lng})
+		}
+		mgs[i] = mg
+	}
+
+	w := p.ResponseWriter
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"records": mrs, "truncated": truncated, "geofences": mgs}); err != nil {
+		c.Warningf("Failed to write JSON response: %v", err)
+	}
+}
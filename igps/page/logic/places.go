@@ -0,0 +1,215 @@
+/*
+Places page logic.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"html/template"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Places"].Logic = places
+}
+
+// places is the logic implementation of the Places page.
+func places(p *page.Params) {
+	c := p.AppCtx
+	fv := p.Request.PostFormValue
+	accKey := p.Account.GetKey(c)
+
+	// Initial values:
+	p.Custom["Radius"] = 100
+
+	var places []*ds.Place
+	if places, p.Err = cache.GetPlaceListForAccKey(c, accKey); p.Err != nil {
+		return
+	}
+
+	// Detect form submits:
+	switch {
+	case fv("submitSave") != "":
+		// Add / Edit Place form submitted!
+		var placeID int64
+		if fv("placeID") != "" {
+			var err error
+			if placeID, err = strconv.ParseInt(fv("placeID"), 10, 64); err != nil || placeByID(places, placeID) == nil {
+				p.ErrorMsg = "You do not have access to the specified Place!"
+				break
+			}
+		}
+		// Checks:
+		var gp appengine.GeoPoint
+		switch {
+		case !checkName(p, fv("name")):
+		case !checkPlaceNameUnique(p, places, fv("name"), placeID):
+		case !checkPlaceLoc(p, fv("loc"), &gp):
+		case !checkPlaceRadius(p, fv("radius")):
+		}
+		if p.ErrorMsg == nil {
+			// All data OK, save Place
+			radius, _ := strconv.ParseInt(fv("radius"), 10, 64)
+			place := ds.Place{Name: strings.TrimSpace(fv("name")), GeoPoint: gp, Radius: radius, Created: time.Now()}
+			key := datastore.NewIncompleteKey(c, ds.ENamePlace, accKey)
+			if placeID != 0 {
+				key = datastore.NewKey(c, ds.ENamePlace, "", placeID, accKey)
+				place.Created = placeByID(places, placeID).Created
+			}
+			if _, p.Err = datastore.Put(c, key, &place); p.Err != nil {
+				return // Datastore error
+			}
+			p.InfoMsg = "Place saved successfully."
+			// Clear from memcache:
+			cache.ClearPlaceListForAccKey(c, accKey)
+		} else {
+			// Submitted values
+			p.Custom["PlaceID"] = fv("placeID")
+			p.Custom["Name"] = fv("name")
+			p.Custom["Loc"] = fv("loc")
+			p.Custom["Radius"] = fv("radius")
+		}
+	case fv("submitDelete") != "":
+		// Delete Place form submitted!
+		placeID, err := strconv.ParseInt(fv("placeID"), 10, 64)
+		if err != nil || placeByID(places, placeID) == nil {
+			p.ErrorMsg = "You do not have access to the specified Place!"
+			break
+		}
+		if p.Err = datastore.Delete(c, datastore.NewKey(c, ds.ENamePlace, "", placeID, accKey)); p.Err != nil {
+			return // Datastore error
+		}
+		p.InfoMsg = "Place deleted successfully."
+		// Clear from memcache:
+		cache.ClearPlaceListForAccKey(c, accKey)
+	}
+
+	if p.InfoMsg != nil {
+		// Places changed, reload them (ancestor queries are strongly consistent).
+		if places, p.Err = cache.GetPlaceListForAccKey(c, accKey); p.Err != nil {
+			return
+		}
+	}
+
+	p.Custom["Places"] = places
+}
+
+// checkPlaceNameUnique checks if the specified Place name is unique (case-insensitive) among the places
+// (except the Place with the specified ID), and sets an appropriate error message if not.
+// Returns true if is acceptable (unique).
+func checkPlaceNameUnique(p *page.Params, places []*ds.Place, name string, placeID int64) (ok bool) {
+	if pl := placeByName(places, name); pl != nil && pl.KeyID != placeID {
+		p.ErrorMsg = SExecTempl(`You already have a Place named <span class="highlight">{{.}}</span>!`, pl.Name)
+		return false
+	}
+
+	return true
+}
+
+// checkPlaceLoc checks the specified Place location ("lat,lng") and sets an appropriate error message
+// if there's something wrong with it. The parsed location is stored in gp.
+// Returns true if is acceptable (valid).
+func checkPlaceLoc(p *page.Params, loc string, gp *appengine.GeoPoint) (ok bool) {
+	var valid bool
+	if *gp, valid = parseLatLng(loc); !valid {
+		p.ErrorMsg = template.HTML(`Invalid <span class="code">Location</span>! Format: "latitude,longitude" in range [-90, 90] latitude and [-180, 180] longitude`)
+		return false
+	}
+
+	return true
+}
+
+// checkPlaceRadius checks the specified Place radius and sets an appropriate error message
+// if there's something wrong with it.
+// Returns true if is acceptable (valid).
+func checkPlaceRadius(p *page.Params, radius string) (ok bool) {
+	basemsg := `Invalid <span class="code">Radius</span>!`
+
+	num, err := strconv.ParseInt(radius, 10, 64)
+	if err != nil {
+		p.ErrorMsg = template.HTML(basemsg)
+		return false
+	}
+	if num < 1 || num > 100*1000 {
+		p.ErrorMsg = SExecTempl(basemsg+` Value is outside of valid range (1..100,000): <span class="highlight">{{.}}</span>`, num)
+		return false
+	}
+
+	return true
+}
+
+// placeByID returns the Place with the specified ID from places, or nil if not found.
+func placeByID(places []*ds.Place, placeID int64) *ds.Place {
+	for _, pl := range places {
+		if pl.KeyID == placeID {
+			return pl
+		}
+	}
+	return nil
+}
+
+// placeByName returns the Place with the specified name (case-insensitive) from places, or nil if not found.
+func placeByName(places []*ds.Place, name string) *ds.Place {
+	name = strings.TrimSpace(name)
+	for _, pl := range places {
+		if strings.EqualFold(pl.Name, name) {
+			return pl
+		}
+	}
+	return nil
+}
+
+// placeAt returns the Place from places the specified location falls in (which is within the radius of the Place).
+// If the location falls in multiple places, the closest one is returned.
+// Returns nil if the location is not in any of the places.
+func placeAt(places []*ds.Place, gp appengine.GeoPoint) (place *ds.Place) {
+	var minDist int64
+	for _, pl := range places {
+		d := Distance(pl.GeoPoint.Lat, pl.GeoPoint.Lng, gp.Lat, gp.Lng)
+		if d <= pl.Radius && (place == nil || d < minDist) {
+			place, minDist = pl, d
+		}
+	}
+	return
+}
+
+// recordPlaces returns the places of the specified records (must be in chronological order),
+// a slice aligned with records (nil elements for records not in any of the places).
+// Locations of events are determined by evtGeoPoint().
+func recordPlaces(records []*ds.GPS, places []*ds.Place) []*ds.Place {
+	rps := make([]*ds.Place, len(records))
+	if len(places) == 0 {
+		return rps
+	}
+	for i, r := range records {
+		if r.Track() {
+			rps[i] = placeAt(places, r.GeoPoint)
+		} else if gp, ok := evtGeoPoint(records, i); ok {
+			rps[i] = placeAt(places, gp)
+		}
+	}
+	return rps
+}
+
+// reversedPlaces returns a new slice with the specified places in reverse order.
+func reversedPlaces(places []*ds.Place) []*ds.Place {
+	rps := make([]*ds.Place, len(places))
+	for i, pl := range places {
+		rps[len(places)-1-i] = pl
+	}
+	return rps
+}
+
+// labelStays sets the Place of the specified stays, the Place their centers fall in.
+func labelStays(stays []*stay, places []*ds.Place) {
+	for _, s := range stays {
+		s.Place = placeAt(places, s.GeoPoint)
+	}
+}
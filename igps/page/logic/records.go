@@ -0,0 +1,781 @@
+/*
+Shared utilities to select, load and process GPS records, used by page logics.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"html/template"
+	"igps/ds"
+	"igps/page"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time layout of the Before and After filters.
+const timeLayout = "06-01-02 15:04:05"
+
+// checkDevice checks the specified device ID and returns the Device if it is owned by the user.
+// Sets an appropriate error message and returns nil if the device ID is invalid.
+func checkDevice(p *page.Params, devIDst string, devices []*ds.Device) *ds.Device {
+	devID, err := strconv.ParseInt(devIDst, 10, 64)
+	if err != nil {
+		p.ErrorMsg = "Invalid Device! Please select a Device from the list."
+		return nil
+	}
+
+	// Check if device is owned by the user:
+	for _, d := range devices {
+		if d.KeyID == devID {
+			return d
+		}
+	}
+
+	p.ErrorMsg = "You do not have access to the specified Device! Please select a Device from the list."
+	return nil
+}
+
+// Max number of Devices whose records can be displayed together (merged) on the Logs page.
+const maxMergedDevices = 5
+
+// checkDevices checks the specified device IDs (see checkDevice()) and returns the Devices in the specified order.
+// Duplicates are dropped.
+// Sets an appropriate error message and returns nil if a device ID is invalid or there are too many of them.
+func checkDevices(p *page.Params, devIDsts []string, devices []*ds.Device) []*ds.Device {
+	if len(devIDsts) == 0 {
+		p.ErrorMsg = "Invalid Device! Please select a Device from the list."
+		return nil
+	}
+
+	devs := make([]*ds.Device, 0, len(devIDsts))
+	dups := make(map[int64]bool, len(devIDsts))
+	for _, devIDst := range devIDsts {
+		dev := checkDevice(p, devIDst, devices)
+		if dev == nil {
+			return nil
+		}
+		if !dups[dev.KeyID] {
+			dups[dev.KeyID] = true
+			devs = append(devs, dev)
+		}
+	}
+
+	if len(devs) > maxMergedDevices {
+		p.ErrorMsg = SExecTempl("Too many Devices selected! At most {{.}} Devices can be displayed together.", maxMergedDevices)
+		return nil
+	}
+
+	return devs
+}
+
+// Colors of the Devices on maps when the records of several Devices are displayed together,
+// assigned to the Devices in the order they are selected. Colors are in "#rrggbb" format.
+var devColors = []string{"#0000ff", "#e6007e", "#ff8c00", "#008b8b", "#8b4513"}
+
+// devColorMap returns the colors of the specified Devices (see devColors) mapped from their IDs.
+// Returns nil if there is only 1 Device, whose records are displayed with the default colors.
+func devColorMap(devs []*ds.Device) map[int64]string {
+	if len(devs) < 2 {
+		return nil
+	}
+	clrs := make(map[int64]string, len(devs))
+	for i, dev := range devs {
+		clrs[dev.KeyID] = devColors[i%len(devColors)]
+	}
+	return clrs
+}
+
+// parseTimeFilters parses the Before and After time filters from the "before" and "after" form values.
+// Zero time is returned for filters not specified.
+// Sets an appropriate error message and returns false if a filter is invalid.
+func parseTimeFilters(p *page.Params) (before, after time.Time, ok bool) {
+	fv := p.Request.FormValue
+
+	var err error
+	if fv("before") != "" {
+		if before, err = p.ParseTime(timeLayout, strings.TrimSpace(fv("before"))); err != nil {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Before</span>!`)
+			return
+		}
+		// Add 1 second to the parsed time because fraction of a second is not parsed but exists,
+		// so this new time will also include records which has the same time up to the second part and has millisecond part too.
+		before = before.Add(time.Second)
+	}
+	if fv("after") != "" {
+		if after, err = p.ParseTime(timeLayout, strings.TrimSpace(fv("after"))); err != nil {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">After</span>!`)
+			return
+		}
+	}
+
+	return before, after, true
+}
+
+// parseLocFilter parses the Location filter from the "loc" form value,
+// and returns the Area code to filter by, or -1 if no Location filter is specified.
+// The Location filter is either a "lat,lng" string or the name of a Place.
+// Location filter is only applied if the device is indexed.
+// Sets an appropriate error message and returns false if the filter is invalid.
+func parseLocFilter(p *page.Params, dev *ds.Device, places []*ds.Place) (areaCode int64, ok bool) {
+	loc := strings.TrimSpace(p.Request.FormValue("loc"))
+	if !dev.Indexed() || loc == "" {
+		return -1, true
+	}
+
+	if pl := placeByName(places, loc); pl != nil {
+		return AreaCodeForGeoPt(dev.AreaSize, pl.GeoPoint.Lat, pl.GeoPoint.Lng), true
+	}
+
+	// GPS coordinates; lat must be in range -90..90, lng must be in range -180..180
+	if strings.Count(loc, ",") != 1 {
+		p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Location</span>! It must be "latitude,longitude" or the name of a Place.`)
+		return
+	}
+	searchLoc, valid := parseLatLng(loc)
+	if !valid {
+		p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Location</span> specified by latitude and longitude! Valid range: [-90, 90] latitude and [-180, 180] longitude`)
+		return
+	}
+
+	return AreaCodeForGeoPt(dev.AreaSize, searchLoc.Lat, searchLoc.Lng), true
+}
+
+// parseLatLng parses a location in "lat,lng" format.
+// Returns false if the format is invalid or the coordinates are out of range.
+func parseLatLng(s string) (gp appengine.GeoPoint, ok bool) {
+	coords := strings.Split(s, ",")
+	if len(coords) != 2 {
+		return
+	}
+
+	var err error
+	if gp.Lat, err = strconv.ParseFloat(strings.TrimSpace(coords[0]), 64); err != nil {
+		return
+	}
+	if gp.Lng, err = strconv.ParseFloat(strings.TrimSpace(coords[1]), 64); err != nil {
+		return
+	}
+
+	return gp, gp.Valid()
+}
+
+// Max tolerance of track simplification in meters.
+const maxSimplifyTolerance = 10000
+
+// parseSimplifyTolerance parses the tolerance of track simplification (see simplifyTrack()) in meters
+// from the "simplify" form value. 0 is returned if not specified (no simplification).
+// Sets an appropriate error message and returns false if the value is invalid.
+func parseSimplifyTolerance(p *page.Params) (tolerance float64, ok bool) {
+	s := strings.TrimSpace(p.Request.FormValue("simplify"))
+	if s == "" {
+		return 0, true
+	}
+	t, err := strconv.Atoi(s)
+	if err != nil || t < 0 || t > maxSimplifyTolerance {
+		p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">simplify</span>! Valid range: 0..{{.}} meters`, maxSimplifyTolerance)
+		return 0, false
+	}
+	return float64(t), true
+}
+
+// Event filters of GPS records (see recFilter).
+const (
+	evtFilterAll    = ""       // All records
+	evtFilterTrack  = "track"  // Track records only
+	evtFilterEvents = "events" // Events (Start and Stop) only
+)
+
+// Max value of the speed filters in km/h.
+const maxFilterSpeed = 2000
+
+// recFilter is a filter of GPS records applied in memory, for filters the datastore queries do not support.
+type recFilter struct {
+	// Event filter, one of evtFilterXXX
+	Evt string
+
+	// Speed range in km/h, 0 means no limit. Speed is calculated from the metrics (see calcMetrics()).
+	MinSpeed, MaxSpeed float64
+}
+
+// active tells if the filter filters any records.
+func (f *recFilter) active() bool {
+	return f.Evt != evtFilterAll || f.speed()
+}
+
+// speed tells if the filter filters by speed.
+func (f *recFilter) speed() bool {
+	return f.MinSpeed > 0 || f.MaxSpeed > 0
+}
+
+// match tells if the specified record matches the filter.
+// If the filter filters by speed, the metrics of the record must be calculated.
+func (f *recFilter) match(r *ds.GPS) bool {
+	switch f.Evt {
+	case evtFilterTrack:
+		if !r.Track() {
+			return false
+		}
+	case evtFilterEvents:
+		if r.Track() {
+			return false
+		}
+	}
+	if f.speed() {
+		// Only Track records with metrics have speed
+		if !r.Track() || !r.Metrics() || r.Dt <= 0 {
+			return false
+		}
+		v := float64(r.Dd) / r.Dt.Hours() / 1000
+		if f.MinSpeed > 0 && v < f.MinSpeed || f.MaxSpeed > 0 && v > f.MaxSpeed {
+			return false
+		}
+	}
+	return true
+}
+
+// filterRecords returns the records matching the specified filter. Records must be in chronological order,
+// map colors of the Track records are determined before filtering (see presetTrackColors()).
+func filterRecords(records []*ds.GPS, f *recFilter) []*ds.GPS {
+	if !f.active() {
+		return records
+	}
+	presetTrackColors(records)
+	var matching []*ds.GPS
+	for _, r := range records {
+		if f.match(r) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// parseRecFilter parses the in-memory filter of GPS records from the "evt", "minSpeed" and "maxSpeed" (km/h) form values.
+// Sets an appropriate error message and returns false if a value is invalid.
+func parseRecFilter(p *page.Params) (f *recFilter, ok bool) {
+	fv := p.Request.FormValue
+
+	f = &recFilter{Evt: fv("evt")}
+	switch f.Evt {
+	case evtFilterAll, evtFilterTrack, evtFilterEvents:
+	default:
+		p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Event</span> filter!`)
+		return nil, false
+	}
+
+	parseSpeed := func(name, label string) (v float64, ok bool) {
+		s := strings.TrimSpace(fv(name))
+		if s == "" {
+			return 0, true
+		}
+		var err error
+		if v, err = strconv.ParseFloat(s, 64); err != nil || v < 0 || v > maxFilterSpeed {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">`+label+`</span>! Valid range: 0..{{.}} km/h`, maxFilterSpeed)
+			return 0, false
+		}
+		return v, true
+	}
+	if f.MinSpeed, ok = parseSpeed("minSpeed", "Min speed"); !ok {
+		return nil, false
+	}
+	if f.MaxSpeed, ok = parseSpeed("maxSpeed", "Max speed"); !ok {
+		return nil, false
+	}
+	if f.MaxSpeed > 0 && f.MinSpeed > f.MaxSpeed {
+		p.ErrorMsg = template.HTML(`<span class="highlight">Min speed</span> must not be greater than <span class="highlight">Max speed</span>!`)
+		return nil, false
+	}
+
+	return f, true
+}
+
+// loadRecords loads the GPS records of the specified device created between after and before,
+// and returns them in chronological order. Zero before or after means no limit in that direction.
+// If areaCode is not negative, only records in the Area identified by it are loaded.
+//
+// At most max records are loaded. If there are more, the latest max records are returned
+// and truncated will be true.
+//
+// The latest records are needed, so the query uses the (G: d, -t) index and the result is reversed in memory.
+func loadRecords(c appengine.Context, devID int64, before, after time.Time, areaCode int64, max int) (records []*ds.GPS, truncated bool, err error) {
+	// Query 1 more to know if the result is truncated
+	q := gpsQuery(devID, before, after, areaCode).Order("-" + ds.PNameCreated).Limit(max + 1)
+
+	if _, err = q.GetAll(c, &records); err != nil {
+		return nil, false, err
+	}
+	if len(records) > max {
+		records, truncated = records[:max], true
+	}
+
+	// Reverse to chronological order
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	return records, truncated, nil
+}
+
+// loadMergedRecords loads the GPS records of the specified devices with loadRecords()
+// (at most max records of each), and returns the latest max records of them merged in chronological order.
+// areaCodes holds the Area code to filter by for each device.
+func loadMergedRecords(c appengine.Context, devs []*ds.Device, before, after time.Time, areaCodes []int64, max int) (records []*ds.GPS, truncated bool, err error) {
+	lists := make([][]*ds.GPS, len(devs))
+	for i, dev := range devs {
+		var trunc bool
+		if lists[i], trunc, err = loadRecords(c, dev.KeyID, before, after, areaCodes[i], max); err != nil {
+			return nil, false, err
+		}
+		truncated = truncated || trunc
+	}
+
+	records = mergeRecords(lists, false)
+	if len(records) > max {
+		records, truncated = records[len(records)-max:], true
+	}
+
+	return records, truncated, nil
+}
+
+// gpsQuery returns a query of the GPS records of the specified device created between after and before.
+// Zero before or after means no limit in that direction.
+// If areaCode is not negative, only records in the Area identified by it are queried.
+func gpsQuery(devID int64, before, after time.Time, areaCode int64) *datastore.Query {
+	q := datastore.NewQuery(ds.ENameGPS).Filter(ds.PNameDevKeyID+"=", devID)
+	if !before.IsZero() {
+		q = q.Filter(ds.PNameCreated+"<", before)
+	}
+	if !after.IsZero() {
+		q = q.Filter(ds.PNameCreated+">", after)
+	}
+	if areaCode >= 0 {
+		q = q.Filter(ds.PNameAreaCodes+"=", areaCode)
+	}
+	return q
+}
+
+// Max number of GPS records of a device scanned for a page when records are filtered in memory (see recFilter).
+const maxPageScan = 5000
+
+// loadPage loads a page of the GPS records of the specified devices (see gpsQuery()) matching filter, merged in
+// reverse chronological order (chronological if asc is true): the latest (earliest if asc) pageSize records of all devices.
+// areaCodes holds the Area code to filter by for each device.
+//
+// Paging is done with a cursor for each device: cursors holds the start cursors of the page (empty for the first page),
+// and the returned next holds the cursors of the next page. A cursor of a device points right after
+// the records of the device included in the page.
+//
+// If filter is active, records are filtered in memory and at most maxPageScan records of a device are scanned
+// for a page; limited tells if scanning of a device stopped due to this limit. If filter is by speed,
+// metrics of the returned records are calculated with the neighbour records of the query (see calcMetrics()).
+// Map colors of the returned records are also determined by the scanned neighbours (see presetTrackColors()).
+func loadPage(c appengine.Context, devs []*ds.Device, before, after time.Time, areaCodes []int64, cursors []string,
+	pageSize int, filter *recFilter, asc bool) (records []*ds.GPS, next []string, limited bool, err error) {
+
+	order := "-" + ds.PNameCreated
+	if asc {
+		order = ds.PNameCreated
+	}
+	scanLimit := pageSize
+	if filter.active() {
+		scanLimit = maxPageScan
+	}
+
+	queries := make([]*datastore.Query, len(devs))
+	scans := make([]*pageScan, len(devs))
+	lists := make([][]*ds.GPS, len(devs))
+
+	// A device can't have more than pageSize records in the page, scan until that many match:
+	for i, dev := range devs {
+		q := gpsQuery(dev.KeyID, before, after, areaCodes[i]).Order(order)
+		if len(cursors) > 0 && cursors[i] != "" {
+			var cursor datastore.Cursor
+			if cursor, err = datastore.DecodeCursor(cursors[i]); err != nil {
+				return
+			}
+			q = q.Start(cursor)
+		}
+		queries[i] = q
+
+		sc := &pageScan{filter: filter, asc: asc}
+		sc.it = q.Limit(scanLimit).Run(c)
+		if asc && filter.speed() && len(cursors) > 0 && cursors[i] != "" {
+			// Metrics of the first record of the page are calculated with the last record of the previous page
+			sc.prevTrack = func(t time.Time) (*ds.GPS, error) {
+				return prevTrackRecord(c, dev.KeyID, t, after, areaCodes[i])
+			}
+		}
+		if err = sc.scan(pageSize, scanLimit); err != nil {
+			return
+		}
+		if filter.active() {
+			// Map colors are determined by the neighbours scanned, not by the matching ones
+			if asc {
+				presetTrackColors(sc.all)
+			} else {
+				presetTrackColors(reversedRecords(sc.all))
+			}
+		}
+		limited = limited || sc.limited
+		scans[i], lists[i] = sc, sc.kept
+	}
+
+	records = mergeRecords(lists, !asc)
+	if len(records) > pageSize {
+		records = records[:pageSize]
+	}
+
+	// Cursors of the next page
+	counts := make(map[int64]int, len(devs)) // Number of records of the devices in the page
+	for _, r := range records {
+		counts[r.DevKeyID]++
+	}
+	next = make([]string, len(devs))
+	for i, dev := range devs {
+		sc := scans[i]
+
+		// Number of scanned records the next page can skip
+		var skip int
+		switch n := counts[dev.KeyID]; {
+		case n > 0:
+			// Right after the last record in the page
+			skip = sc.pos[n-1]
+		case len(sc.kept) > 0:
+			// None of the matching records are in the page, next page starts at the first of them
+			skip = sc.pos[0] - 1
+		default:
+			// No matching records, records not matching can be skipped
+			skip = sc.decided
+		}
+
+		t := sc.it
+		switch {
+		case skip == 0:
+			// Next page starts at the same cursor
+			if len(cursors) > 0 {
+				next[i] = cursors[i]
+			}
+			continue
+		case skip == sc.scanned:
+			// The cursor of the query is right after the scanned records
+		default:
+			// Re-run the query (keys only) up to the last record to skip to get the cursor right after it
+			t = queries[i].KeysOnly().Limit(skip).Run(c)
+			for {
+				if _, err = t.Next(nil); err == datastore.Done {
+					break
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+		var cursor datastore.Cursor
+		if cursor, err = t.Cursor(); err != nil {
+			return
+		}
+		next[i] = cursor.String()
+	}
+
+	return records, next, limited, nil
+}
+
+// pageScan scans the records of a device for a page (see loadPage()), and keeps the ones matching a filter.
+type pageScan struct {
+	filter *recFilter
+	asc    bool // Tells if records are scanned in chronological order
+	it     *datastore.Iterator
+
+	// prevTrack returns the Track record preceding the specified time (nil if none),
+	// to calculate metrics of the first record when scanning in chronological order. Optional.
+	prevTrack func(t time.Time) (*ds.GPS, error)
+
+	all     []*ds.GPS // Scanned records if the filter is active (in the order of scanning)
+	kept    []*ds.GPS // Matching records
+	pos     []int     // Positions of the matching records (number of records scanned up to and including them)
+	scanned int       // Number of scanned records
+	decided int       // Number of leading scanned records it is decided whether they match
+	limited bool      // Tells if scanning stopped due to the scan limit
+
+	// Record waiting for its metrics: when scanning in reverse chronological order,
+	// metrics of a Track record are calculated with the next scanned Track record (see calcMetrics()).
+	pending    *ds.GPS
+	pendingPos int
+	last       *ds.GPS // Last scanned Track record when scanning in chronological order
+}
+
+// scan scans records until max records match or scanLimit records are scanned.
+func (sc *pageScan) scan(max, scanLimit int) error {
+	for len(sc.kept) < max {
+		if sc.scanned == scanLimit {
+			sc.limited = sc.filter.active()
+			break
+		}
+		r := new(ds.GPS)
+		if _, err := sc.it.Next(r); err == datastore.Done {
+			// End of records, the pending record has no metrics
+			sc.decide(sc.pending, sc.pendingPos)
+			sc.pending, sc.decided = nil, sc.scanned
+			break
+		} else if err != nil {
+			return err
+		}
+		sc.scanned++
+		if sc.filter.active() {
+			sc.all = append(sc.all, r)
+		}
+
+		if !sc.filter.speed() || !r.Track() {
+			if sc.pending == nil {
+				sc.decided = sc.scanned
+			}
+			sc.decide(r, sc.scanned)
+			continue
+		}
+
+		r.Dd = -1
+		if sc.asc {
+			if sc.last == nil && sc.prevTrack != nil {
+				var err error
+				if sc.last, err = sc.prevTrack(r.Created); err != nil {
+					return err
+				}
+			}
+			if sc.last != nil {
+				r.Dd = Distance(sc.last.GeoPoint.Lat, sc.last.GeoPoint.Lng, r.GeoPoint.Lat, r.GeoPoint.Lng)
+				r.Dt = r.Created.Sub(sc.last.Created)
+			}
+			sc.last, sc.decided = r, sc.scanned
+			sc.decide(r, sc.scanned)
+			continue
+		}
+
+		if p := sc.pending; p != nil {
+			p.Dd = Distance(r.GeoPoint.Lat, r.GeoPoint.Lng, p.GeoPoint.Lat, p.GeoPoint.Lng)
+			p.Dt = p.Created.Sub(r.Created)
+			sc.decide(p, sc.pendingPos)
+		}
+		sc.pending, sc.pendingPos = r, sc.scanned
+		sc.decided = sc.scanned - 1
+	}
+
+	return nil
+}
+
+// decide keeps the specified record at the specified position if it matches the filter. r may be nil.
+func (sc *pageScan) decide(r *ds.GPS, pos int) {
+	if r != nil && sc.filter.match(r) {
+		sc.kept = append(sc.kept, r)
+		sc.pos = append(sc.pos, pos)
+	}
+}
+
+// prevTrackRecord returns the latest Track record of the specified device created before t (and after after,
+// in the Area identified by areaCode if not negative). Returns nil if there is no such record.
+func prevTrackRecord(c appengine.Context, devID int64, t, after time.Time, areaCode int64) (*ds.GPS, error) {
+	// Events are rare, a few records are enough to find a Track record
+	for it := gpsQuery(devID, t, after, areaCode).Order("-" + ds.PNameCreated).Limit(10).Run(c); ; {
+		r := new(ds.GPS)
+		if _, err := it.Next(r); err == datastore.Done {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if r.Track() {
+			return r, nil
+		}
+	}
+}
+
+// mergeRecords merges the specified lists of GPS records into one list ordered by time.
+// Each list must be in chronological order if desc is false, or in reverse chronological order if desc is true;
+// the merged list will be in the same order.
+func mergeRecords(lists [][]*ds.GPS, desc bool) []*ds.GPS {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+
+	n := 0
+	for _, l := range lists {
+		n += len(l)
+	}
+	merged := make([]*ds.GPS, 0, n)
+	idxs := make([]int, len(lists)) // Index of the next record of each list
+
+	for len(merged) < n {
+		// Choose the list whose next record comes first:
+		min := -1
+		for i, l := range lists {
+			if idxs[i] == len(l) {
+				continue
+			}
+			if min < 0 {
+				min = i
+				continue
+			}
+			t, tmin := l[idxs[i]].Created, lists[min][idxs[min]].Created
+			if desc && t.After(tmin) || !desc && t.Before(tmin) {
+				min = i
+			}
+		}
+		merged = append(merged, lists[min][idxs[min]])
+		idxs[min]++
+	}
+
+	return merged
+}
+
+// reversedRecords returns a new slice with the specified records in reverse order.
+func reversedRecords(records []*ds.GPS) []*ds.GPS {
+	recs := make([]*ds.GPS, len(records))
+	for i, r := range records {
+		recs[len(records)-1-i] = r
+	}
+	return recs
+}
+
+// calcMetrics calculates the delta distance and delta time (metrics) of the specified records
+// which must be in chronological order.
+// Metrics of a Track record are calculated with the previous Track record of the same device
+// (non-Track records and records of other devices are skipped).
+// Records with no metrics will have a Dd = -1.
+func calcMetrics(records []*ds.GPS) {
+	prevs := make(map[int64]*ds.GPS) // Previous Track records mapped from device IDs
+	for _, r := range records {
+		r.Dd = -1
+		if !r.Track() {
+			continue
+		}
+		if prev := prevs[r.DevKeyID]; prev != nil {
+			r.Dd = Distance(prev.GeoPoint.Lat, prev.GeoPoint.Lng, r.GeoPoint.Lat, r.GeoPoint.Lng)
+			r.Dt = r.Created.Sub(prev.Created)
+		}
+		prevs[r.DevKeyID] = r
+	}
+}
+
+// splitTrips splits the specified records (must be in chronological order) into trips.
+// A trip is the list of Track records of a device between a Start and a Stop event of the device.
+// Track records preceding the first Start or following the last Stop also form a trip,
+// because the time range of the records may begin or end in the middle of a trip.
+// Records of different devices are split separately (trips of a device never contain records of another).
+// Empty trips are not returned.
+func splitTrips(records []*ds.GPS) (trips [][]*ds.GPS) {
+	var devIDs []int64                    // Device IDs in order of first occurrence
+	devTrips := make(map[int64][]*ds.GPS) // Current trips mapped from device IDs
+	for _, r := range records {
+		trip, ok := devTrips[r.DevKeyID]
+		if !ok {
+			devIDs = append(devIDs, r.DevKeyID)
+		}
+		if r.Track() {
+			devTrips[r.DevKeyID] = append(trip, r)
+			continue
+		}
+		switch r.Evt() {
+		case ds.EvtStart, ds.EvtStop:
+			if len(trip) > 0 {
+				trips = append(trips, trip)
+			}
+			devTrips[r.DevKeyID] = nil
+		}
+	}
+	for _, devID := range devIDs {
+		if trip := devTrips[devID]; len(trip) > 0 {
+			trips = append(trips, trip)
+		}
+	}
+
+	return
+}
+
+// Colors of Track records on maps.
+const (
+	clrTrack      = "blue"
+	clrAfterStart = "green"
+	clrBeforeStop = "red"
+)
+
+// trackColors returns the colors of the Track records of the specified records (must be in chronological order)
+// on maps (see trackColor()), mapped from the records. Neighbour records are those of the same device.
+// Colors preset before the records were filtered (see presetTrackColors()) take precedence.
+// If devClrs is not nil (see devColorMap()), the color of the device is used instead of clrTrack.
+func trackColors(records []*ds.GPS, devClrs map[int64]string) map[*ds.GPS]string {
+	devRecs := make(map[int64][]*ds.GPS) // Records grouped by device IDs
+	for _, r := range records {
+		devRecs[r.DevKeyID] = append(devRecs[r.DevKeyID], r)
+	}
+
+	clrs := make(map[*ds.GPS]string, len(records))
+	for devID, recs := range devRecs {
+		for i, r := range recs {
+			if !r.Track() {
+				continue
+			}
+			var earlier, later *ds.GPS
+			if i > 0 {
+				earlier = recs[i-1]
+			}
+			if i < len(recs)-1 {
+				later = recs[i+1]
+			}
+			clr := r.Clr
+			if clr == "" {
+				clr = trackColor(earlier, later)
+			}
+			if clr == clrTrack && devClrs != nil {
+				clr = devClrs[devID]
+			}
+			clrs[r] = clr
+		}
+	}
+	return clrs
+}
+
+// presetTrackColors sets the Clr field of the Track records of the specified records (must be in chronological order)
+// to their colors on maps, so they keep their colors if their neighbours are filtered out.
+func presetTrackColors(records []*ds.GPS) {
+	for r, clr := range trackColors(records, nil) {
+		r.Clr = clr
+	}
+}
+
+// trackColor returns the color of a Track record on maps, determined by its neighbour records
+// (earlier and later in time, nil if there is none):
+// first records after a Start event are green, last records before a Stop event are red,
+// others are blue.
+func trackColor(earlier, later *ds.GPS) string {
+	switch {
+	case earlier != nil && earlier.Evt() == ds.EvtStart:
+		return clrAfterStart
+	case later != nil && later.Evt() == ds.EvtStop:
+		return clrBeforeStop
+	}
+	return clrTrack
+}
+
+// evtGeoPoint returns the position of a non-Track record (event) of the specified records
+// (must be in chronological order), identified by its index.
+// Events have no location, so the location of the first following Track record (of the same device)
+// is used for Start events, and the location of the last preceding Track record for other events.
+// Returns false if there is no such Track record.
+func evtGeoPoint(records []*ds.GPS, idx int) (gp appengine.GeoPoint, ok bool) {
+	devID := records[idx].DevKeyID
+	if records[idx].Evt() == ds.EvtStart {
+		for _, r := range records[idx+1:] {
+			if r.Track() && r.DevKeyID == devID {
+				return r.GeoPoint, true
+			}
+		}
+		return
+	}
+
+	for i := idx - 1; i >= 0; i-- {
+		if r := records[i]; r.Track() && r.DevKeyID == devID {
+			return r.GeoPoint, true
+		}
+	}
+	return
+}
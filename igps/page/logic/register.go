@@ -7,10 +7,10 @@ package logic
 import (
 	"appengine"
 	"appengine/datastore"
-	"appengine/mail"
 	"fmt"
 	"igps/cache"
 	"igps/ds"
+	"igps/notify"
 	"igps/page"
 	"strings"
 	"time"
@@ -77,19 +77,12 @@ func register(p *page.Params) {
 	}
 
 	// Send registration email (Account info email)
-	const adminEmail = "Andras Belicza <iczaaa@gmail.com>"
-	msg := &mail.Message{
-		Sender:  adminEmail,
-		To:      []string{acc.Email},
-		Bcc:     []string{adminEmail},
-		ReplyTo: adminEmail,
-		Subject: "[IczaGPS] Account Info",
-		Body:    fmt.Sprintf(accountInfoMail, acc.Email),
-	}
+	email := &notify.Email{To: []string{acc.Email}, Bcc: []string{notify.AdminEmail}}
 	if len(acc.ContactEmail) > 0 {
-		msg.Cc = []string{acc.ContactEmail}
+		email.Cc = []string{acc.ContactEmail}
 	}
-	if err := mail.Send(c, msg); err == nil {
+	msg := &notify.Message{Subject: "Account Info", Body: fmt.Sprintf(accountInfoMail, acc.Email)}
+	if err := email.Notify(c, msg); err == nil {
 		c.Infof("Sent successful registration email.")
 	} else {
 		c.Errorf("Couldn't send email: %v", err)
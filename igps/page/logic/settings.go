@@ -6,9 +6,14 @@ package logic
 
 import (
 	"appengine/datastore"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"html/template"
 	"igps/cache"
 	"igps/ds"
+	"igps/maps"
+	"igps/notify"
 	"igps/page"
 	"strconv"
 	"strings"
@@ -25,17 +30,42 @@ func init() {
 // settings is the logic implementation of the Settings page.
 func settings(p *page.Params) {
 	p.Custom["ImgFormats"] = imgFormats
+	p.Custom["MapPrevProviders"] = ds.MapPrevProviders
+	p.Custom["MapTypes"] = maps.MapTypes
 
 	fv := p.Request.PostFormValue
 
+	switch {
+	case fv("submitGenAPIToken") != "":
+		changeAPIToken(p, true)
+	case fv("submitDelAPIToken") != "":
+		changeAPIToken(p, false)
+	}
+	if p.Err != nil {
+		return
+	}
+	p.Custom["GeoJSONPath"] = page.NamePageMap["GeoJSON"].Path
+
+	manageChannels(p)
+	if p.Err != nil {
+		return
+	}
+	p.Custom["SignatureHeader"] = notify.SignatureHeader
+
 	if fv("submitSettings") == "" {
 		// No form submitted. Initial values:
 		p.Custom["GoogleAccount"] = p.Account.Email
 		p.Custom["ContactEmail"] = p.Account.ContactEmail
 		p.Custom["LocationName"] = p.Account.LocationName
+		p.Custom["QuietHours"] = p.Account.QuietHours
 		if p.Account.LogsPageSize > 0 {
 			p.Custom["LogsPageSize"] = p.Account.LogsPageSize
 		}
+		p.Custom["MapPrevProvider"] = p.Account.MapPrevProvider
+		p.Custom["MapType"] = p.Account.MapType
+		if p.Account.MapZoom > 0 {
+			p.Custom["MapZoom"] = p.Account.MapZoom
+		}
 		p.Custom["MapPrevSize"] = p.Account.MapPrevSize
 		p.Custom["MobMapPrevSize"] = p.Account.MobMapPrevSize
 		p.Custom["MobMapImgFormat"] = p.Account.MobMapImgFormat
@@ -48,7 +78,11 @@ func settings(p *page.Params) {
 	p.Custom["GoogleAccount"] = fv("googleAccount")
 	p.Custom["ContactEmail"] = fv("contactEmail")
 	p.Custom["LocationName"] = fv("locationName")
+	p.Custom["QuietHours"] = fv("quietHours")
 	p.Custom["LogsPageSize"] = fv("logsPageSize")
+	p.Custom["MapPrevProvider"] = fv("mapPrevProvider")
+	p.Custom["MapType"] = fv("mapType")
+	p.Custom["MapZoom"] = fv("mapZoom")
 	p.Custom["MapPrevSize"] = fv("mapPrevSize")
 	p.Custom["MobMapPrevSize"] = fv("mobMapPrevSize")
 	p.Custom["MobMapImgFormat"] = fv("mobMapImgFormat")
@@ -59,7 +93,11 @@ func settings(p *page.Params) {
 	case !checkGoogleAccounts(p, fv("googleAccount")):
 	case !checkContactEmail(p, fv("contactEmail")):
 	case !checkLocationName(p, fv("locationName")):
+	case !checkSchedule(p, "Quiet hours", fv("quietHours")):
 	case !checkLogsPageSize(p, fv("logsPageSize")):
+	case !checkMapPrevProvider(p, fv("mapPrevProvider")):
+	case !checkMapType(p, fv("mapType")):
+	case !checkMapZoom(p, fv("mapZoom")):
 	case !checkMapPrevSize(p, "Map preview size", fv("mapPrevSize")):
 	case !checkMapPrevSize(p, "Mobile Map preview size", fv("mobMapPrevSize")):
 	case !checkMobMapImgFormat(p, fv("mobMapImgFormat")):
@@ -76,19 +114,25 @@ func settings(p *page.Params) {
 
 	// Create a "copy" of the account, only set it if saving succeeds.
 	// Have to set ALL fields (else their values would be lost when (re)saved)!
-	var logsPageSize, mobPageWidth int
+	var logsPageSize, mapZoom, mobPageWidth int
 	if fv("logsPageSize") != "" {
 		logsPageSize, _ = strconv.Atoi(fv("logsPageSize"))
 	}
+	if fv("mapZoom") != "" {
+		mapZoom, _ = strconv.Atoi(fv("mapZoom"))
+	}
 	if fv("mobPageWidth") != "" {
 		mobPageWidth, _ = strconv.Atoi(fv("mobPageWidth"))
 	}
 	acc := ds.Account{
 		Email: p.User.Email, Lemail: strings.ToLower(p.User.Email), UserID: p.User.ID,
-		ContactEmail: fv("contactEmail"), LocationName: fv("locationName"), LogsPageSize: logsPageSize,
+		ContactEmail: fv("contactEmail"), LocationName: fv("locationName"), QuietHours: strings.TrimSpace(fv("quietHours")),
+		LogsPageSize: logsPageSize,
+		MapPrevProvider: fv("mapPrevProvider"), MapType: fv("mapType"), MapZoom: mapZoom,
 		MapPrevSize: fv("mapPrevSize"), MobMapPrevSize: fv("mobMapPrevSize"),
 		MobMapImgFormat: fv("mobMapImgFormat"), MobPageWidth: mobPageWidth,
-		Created: p.Account.Created, KeyID: p.Account.KeyID,
+		APIToken: p.Account.APIToken,
+		Created:  p.Account.Created, KeyID: p.Account.KeyID,
 	}
 
 	key := datastore.NewKey(c, ds.ENameAccount, "", p.Account.KeyID, nil)
@@ -141,6 +185,63 @@ func checkLogsPageSize(p *page.Params, lps string) (ok bool) {
 	return true
 }
 
+// checkMapPrevProvider checks the specified Map preview provider and sets an appropriate error message
+// if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkMapPrevProvider(p *page.Params, provider string) (ok bool) {
+	for _, v := range ds.MapPrevProviders {
+		if v == provider {
+			return true
+		}
+	}
+
+	p.ErrorMsg = template.HTML(`Invalid <span class="code">Map preview provider</span>!`)
+
+	return false
+}
+
+// checkMapType checks the specified Map type and sets an appropriate error message
+// if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkMapType(p *page.Params, mapType string) (ok bool) {
+	if mapType == "" {
+		return true
+	}
+
+	for _, v := range maps.MapTypes {
+		if v == mapType {
+			return true
+		}
+	}
+
+	p.ErrorMsg = template.HTML(`Invalid <span class="code">Map type</span>!`)
+
+	return false
+}
+
+// checkMapZoom checks the specified Map zoom level string and sets an appropriate error message
+// if there's something wrong with it.
+// Returns true if is acceptable (valid or empty).
+func checkMapZoom(p *page.Params, mz string) (ok bool) {
+	if mz == "" {
+		return true
+	}
+
+	basemsg := `Invalid <span class="code">Map zoom level</span>!`
+
+	num, err := strconv.Atoi(mz)
+	if err != nil {
+		p.ErrorMsg = SExecTempl(basemsg+` Invalid number: <span class="highlight">{{.}}</span>`, mz)
+		return false
+	}
+	if num < 1 || num > 20 {
+		p.ErrorMsg = SExecTempl(basemsg+` Value is outside of valid range (1..20): <span class="highlight">{{.}}</span>`, num)
+		return false
+	}
+
+	return true
+}
+
 // checkMapPrevSize checks the specified Map preview size string and sets an appropriate error message
 // if there's something wrong with it.
 // Returns true if is acceptable (valid or empty).
@@ -214,3 +315,45 @@ func checkMobPageWidth(p *page.Params, mpw string) (ok bool) {
 
 	return true
 }
+
+// changeAPIToken generates a new API token for the account if gen is true,
+// else deletes the API token (which disables API access).
+func changeAPIToken(p *page.Params, gen bool) {
+	c := p.AppCtx
+
+	// Create a copy of the account, only set it if saving succeeds.
+	acc := *p.Account
+	acc.APIToken = ""
+	if gen {
+		b := make([]byte, 24) // Multiple of 3 bytes (ideal for base64 encoding so no padding '=' signs will be needed)
+		if _, p.Err = rand.Read(b); p.Err != nil {
+			return
+		}
+		acc.APIToken = base64.URLEncoding.EncodeToString(b)
+
+		// Check if token is unique. It will be, but better be safe than sorry.
+		q := datastore.NewQuery(ds.ENameAccount).Filter(ds.PNameAPIToken+"=", acc.APIToken).KeysOnly().Limit(1)
+		var accKeys []*datastore.Key
+		if accKeys, p.Err = q.GetAll(c, nil); p.Err != nil {
+			return
+		}
+		if len(accKeys) > 0 {
+			p.Err = fmt.Errorf("Generated API token already exists: %s", acc.APIToken)
+			return
+		}
+	}
+
+	if _, p.Err = datastore.Put(c, acc.GetKey(c), &acc); p.Err != nil {
+		return // Datastore error
+	}
+	cache.ClearAccKeyIDForAPIToken(c, p.Account.APIToken)
+	p.Account = &acc
+	cache.CacheAccount(c, p.Account)
+
+	if gen {
+		p.InfoMsg = "New API token generated successfully."
+		p.ImportantMsg = template.HTML("<b>Important!</b> You have to update the token in your API clients, the old token is no longer valid!")
+	} else {
+		p.InfoMsg = "API token deleted successfully, API access is disabled."
+	}
+}
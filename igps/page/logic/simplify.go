@@ -0,0 +1,101 @@
+/*
+Track simplification.
+
+Simplification uses the Douglas-Peucker algorithm: http://en.wikipedia.org/wiki/Ramer%E2%80%93Douglas%E2%80%93Peucker_algorithm
+*/
+
+package logic
+
+import (
+	"igps/ds"
+	"math"
+)
+
+// simplifyTrack simplifies the specified Track records using the Douglas-Peucker algorithm:
+// records deviating less than tolerance meters from the simplified path are dropped.
+// The first and last records are always kept.
+// The order of the records is preserved, the records slice is not modified.
+// Returns the records slice itself if tolerance is not positive or there is nothing to drop.
+func simplifyTrack(records []*ds.GPS, tolerance float64) []*ds.GPS {
+	if tolerance <= 0 || len(records) < 3 {
+		return records
+	}
+
+	keep := make([]bool, len(records))
+	keep[0], keep[len(records)-1] = true, true
+	kept := 2
+
+	// Ranges (first and last index) to process; a stack instead of recursion,
+	// exports may have thousands of records.
+	stack := [][2]int{{0, len(records) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		maxDist, maxIdx := 0.0, -1
+		for i := first + 1; i < last; i++ {
+			if d := segmentDist(records[i], records[first], records[last]); d > maxDist {
+				maxDist, maxIdx = d, i
+			}
+		}
+		if maxDist < tolerance {
+			continue
+		}
+		keep[maxIdx] = true
+		kept++
+		stack = append(stack, [2]int{first, maxIdx}, [2]int{maxIdx, last})
+	}
+
+	if kept == len(records) {
+		return records
+	}
+	simplified := make([]*ds.GPS, 0, kept)
+	for i, r := range records {
+		if keep[i] {
+			simplified = append(simplified, r)
+		}
+	}
+	return simplified
+}
+
+// simplifyRecords simplifies the trips (see splitTrips()) of the specified records
+// (must be in chronological order) with simplifyTrack().
+// Non-Track records (events) are kept. Metrics are not recalculated.
+// Returns the records slice itself if tolerance is not positive.
+func simplifyRecords(records []*ds.GPS, tolerance float64) []*ds.GPS {
+	if tolerance <= 0 {
+		return records
+	}
+
+	simplified := make([]*ds.GPS, 0, len(records))
+	// Track records are collected and simplified when a non-Track record or the end is reached.
+	var track []*ds.GPS
+	for _, r := range records {
+		if r.Track() {
+			track = append(track, r)
+			continue
+		}
+		simplified = append(append(simplified, simplifyTrack(track, tolerance)...), r)
+		track = track[:0]
+	}
+	return append(simplified, simplifyTrack(track, tolerance)...)
+}
+
+// segmentDist returns the distance of r from the line segment defined by a and b, in meters.
+// Points are projected to a plane with the latitude of a, which is accurate enough
+// for the distances of consecutive GPS records.
+func segmentDist(r, a, b *ds.GPS) float64 {
+	lat := a.GeoPoint.Lat
+	x, y := distFromGr(lat, r.GeoPoint.Lng), distFromEq(r.GeoPoint.Lat)
+	ax, ay := distFromGr(lat, a.GeoPoint.Lng), distFromEq(a.GeoPoint.Lat)
+	bx, by := distFromGr(lat, b.GeoPoint.Lng), distFromEq(b.GeoPoint.Lat)
+
+	dx, dy := bx-ax, by-ay
+	if l2 := dx*dx + dy*dy; l2 > 0 {
+		// Project r onto the segment, clamped to the end points:
+		t := ((x-ax)*dx + (y-ay)*dy) / l2
+		t = math.Max(0, math.Min(1, t))
+		ax, ay = ax+t*dx, ay+t*dy
+	}
+	return math.Hypot(x-ax, y-ay)
+}
@@ -0,0 +1,151 @@
+/*
+Stay point (dwell) detection: finds where a device spent time.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"igps/ds"
+	"igps/page"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default and max parameters of stay detection.
+const (
+	// Default stay radius in meters
+	defStayRadius = 100
+	// Max stay radius in meters
+	maxStayRadius = 5000
+
+	// Default min stay duration in minutes
+	defStayMinDur = 10
+	// Max min stay duration in minutes
+	maxStayMinDur = 24 * 60
+)
+
+// stay is a stay point: a span of time during which the device stayed within a radius around a location.
+type stay struct {
+	// Track records of the stay in chronological order
+	Records []*ds.GPS
+
+	// Center of the stay, the mean location of its records
+	GeoPoint appengine.GeoPoint
+
+	// Place the center of the stay falls in, nil if none (see labelStays())
+	Place *ds.Place
+}
+
+// DevKeyID returns the ID of the Device of the stay.
+func (s *stay) DevKeyID() int64 {
+	return s.Records[0].DevKeyID
+}
+
+// Start returns the start time of the stay, the time of its first record.
+func (s *stay) Start() time.Time {
+	return s.Records[0].Created
+}
+
+// End returns the end time of the stay, the time of its last record.
+func (s *stay) End() time.Time {
+	return s.Records[len(s.Records)-1].Created
+}
+
+// Duration returns the duration of the stay, truncated to seconds.
+func (s *stay) Duration() time.Duration {
+	return s.End().Sub(s.Start()) / time.Second * time.Second
+}
+
+// Count returns the number of records of the stay.
+func (s *stay) Count() int {
+	return len(s.Records)
+}
+
+// detectStays detects the stays in the specified records which must be in chronological order.
+//
+// A stay is a span of consecutive Track records each of which is within radius meters (see Distance())
+// from the first record of the span, and the span lasts at least minDur.
+// Non-Track records (events) are skipped: a device parked between a Stop and a Start event
+// stays at the same place.
+// Records of different devices are processed separately: stays are returned grouped by devices
+// (in order of their first records), in chronological order within a device.
+func detectStays(records []*ds.GPS, radius int64, minDur time.Duration) (stays []*stay) {
+	// Only Track records have location
+	var devIDs []int64                  // Device IDs in order of first occurrence
+	tracks := make(map[int64][]*ds.GPS) // Track records grouped by device IDs
+	for _, r := range records {
+		if !r.Track() {
+			continue
+		}
+		if _, ok := tracks[r.DevKeyID]; !ok {
+			devIDs = append(devIDs, r.DevKeyID)
+		}
+		tracks[r.DevKeyID] = append(tracks[r.DevKeyID], r)
+	}
+
+	for _, devID := range devIDs {
+		stays = append(stays, detectTrackStays(tracks[devID], radius, minDur)...)
+	}
+
+	return
+}
+
+// detectTrackStays detects the stays in the specified Track records of a device (see detectStays()).
+func detectTrackStays(track []*ds.GPS, radius int64, minDur time.Duration) (stays []*stay) {
+	for i := 0; i < len(track); {
+		first := track[i]
+		j := i + 1
+		for ; j < len(track); j++ {
+			if Distance(first.GeoPoint.Lat, first.GeoPoint.Lng, track[j].GeoPoint.Lat, track[j].GeoPoint.Lng) > radius {
+				break
+			}
+		}
+		// Records i..j-1 are within radius
+		if j-i < 2 || track[j-1].Created.Sub(first.Created) < minDur {
+			i++
+			continue
+		}
+
+		s := &stay{Records: track[i:j]}
+		for _, r := range s.Records {
+			s.GeoPoint.Lat += r.GeoPoint.Lat
+			s.GeoPoint.Lng += r.GeoPoint.Lng
+		}
+		s.GeoPoint.Lat /= float64(len(s.Records))
+		s.GeoPoint.Lng /= float64(len(s.Records))
+		stays = append(stays, s)
+
+		i = j
+	}
+
+	return
+}
+
+// parseStayParams parses the parameters of stay detection from the "stayRadius" (meters)
+// and "stayMinDur" (minutes) form values. Defaults are returned for values not specified.
+// Sets an appropriate error message and returns false if a value is invalid.
+func parseStayParams(p *page.Params) (radius int64, minDur time.Duration, ok bool) {
+	fv := p.Request.FormValue
+
+	radius = defStayRadius
+	if s := strings.TrimSpace(fv("stayRadius")); s != "" {
+		var err error
+		if radius, err = strconv.ParseInt(s, 10, 64); err != nil || radius < 1 || radius > maxStayRadius {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">Stay radius</span>! Valid range: 1..{{.}} meters`, maxStayRadius)
+			return
+		}
+	}
+
+	mins := defStayMinDur
+	if s := strings.TrimSpace(fv("stayMinDur")); s != "" {
+		var err error
+		if mins, err = strconv.Atoi(s); err != nil || mins < 1 || mins > maxStayMinDur {
+			p.ErrorMsg = SExecTempl(`Invalid <span class="highlight">Min stay duration</span>! Valid range: 1..{{.}} minutes`, maxStayMinDur)
+			return
+		}
+	}
+
+	return radius, time.Duration(mins) * time.Minute, true
+}
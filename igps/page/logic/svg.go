@@ -0,0 +1,174 @@
+/*
+Server-side SVG rendering of GPS records: a map preview which does not depend on any external map API.
+*/
+
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"igps/ds"
+	"io"
+	"math"
+)
+
+// Padding of the rendered area in SVG maps, in pixels.
+const svgPadding = 24
+
+// Radius of markers in SVG maps, in pixels.
+const svgMarkerR = 8
+
+// svgProj is a projection of geopoints to the pixel coordinates of an SVG map.
+//
+// An equirectangular projection is used with the latitude of the center of the bounds:
+// distances are calculated the same way as by Distance(), accurate enough for the extent of tracks.
+type svgProj struct {
+	lat0             float64 // Reference latitude
+	minX, maxY       float64 // Top-left corner in meters
+	scale            float64 // Pixels per meter
+	offsetX, offsetY float64 // Offset in pixels to center the drawing
+}
+
+// newSVGProj creates a projection which fits the specified records into the specified size.
+func newSVGProj(records []*ds.GPS, width, height int) *svgProj {
+	minLat, maxLat, minLng, maxLng := 90.0, -90.0, 180.0, -180.0
+	for _, r := range records {
+		minLat, maxLat = math.Min(minLat, r.GeoPoint.Lat), math.Max(maxLat, r.GeoPoint.Lat)
+		minLng, maxLng = math.Min(minLng, r.GeoPoint.Lng), math.Max(maxLng, r.GeoPoint.Lng)
+	}
+
+	pr := &svgProj{lat0: (minLat + maxLat) / 2}
+	pr.minX, pr.maxY = distFromGr(pr.lat0, minLng), distFromEq(maxLat)
+	dx, dy := distFromGr(pr.lat0, maxLng)-pr.minX, pr.maxY-distFromEq(minLat)
+
+	// Min extent is 200 meters so a single location (or a parked device) is not zoomed in infinitely.
+	w, h := float64(width-2*svgPadding), float64(height-2*svgPadding)
+	pr.scale = math.Min(w/math.Max(dx, 200), h/math.Max(dy, 200))
+	pr.offsetX = svgPadding + (w-dx*pr.scale)/2
+	pr.offsetY = svgPadding + (h-dy*pr.scale)/2
+
+	return pr
+}
+
+// xy returns the pixel coordinates of the specified record.
+func (pr *svgProj) xy(r *ds.GPS) (x, y float64) {
+	return pr.latLngXY(r.GeoPoint.Lat, r.GeoPoint.Lng)
+}
+
+// latLngXY returns the pixel coordinates of the specified location.
+func (pr *svgProj) latLngXY(lat, lng float64) (x, y float64) {
+	x = pr.offsetX + (distFromGr(pr.lat0, lng)-pr.minX)*pr.scale
+	y = pr.offsetY + (pr.maxY-distFromEq(lat))*pr.scale
+	return
+}
+
+// RenderSVG renders the specified GPS records (must be in chronological order) as an SVG image
+// with the specified size: the path of each trip (see splitTrips()), markers of Track records
+// colored the same way as on static map previews (see trackColors()) and labeled with the Label
+// of the records (if set), a scale bar and a north arrow. Outlines of the specified geofences (may be nil)
+// are drawn beneath the paths; the map is fitted to the records only.
+//
+// Records may be of several devices, in which case devClrs holds the colors of the devices (see devColorMap()),
+// used for their paths and markers. devClrs may be nil for a single device.
+//
+// Markers have the "m<label>" ids so they can be referenced (e.g. highlighted) in HTML pages.
+func RenderSVG(w io.Writer, records []*ds.GPS, devClrs map[int64]string, geofences []*ds.Geofence, width, height int) error {
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Arial, sans-serif" font-size="11">`, width, height, width, height)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="#f2efe9" stroke="#888"/>`, width, height)
+
+	var track []*ds.GPS
+	for _, r := range records {
+		if r.Track() {
+			track = append(track, r)
+		}
+	}
+	if len(track) == 0 {
+		fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">No locations to display.</text>`, width/2, height/2)
+		b.WriteString(`</svg>`)
+		_, err := b.WriteTo(w)
+		return err
+	}
+
+	pr := newSVGProj(track, width, height)
+
+	// GEOFENCES
+
+	for _, gf := range geofences {
+		fmt.Fprintf(b, `<polygon fill="%s" fill-opacity="0.1" stroke="%s" stroke-width="1.5" stroke-dasharray="4,2" points="`, clrGeofence, clrGeofence)
+		for i, pt := range geofenceOutline(gf) {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			x, y := pr.latLngXY(pt.Lat, pt.Lng)
+			fmt.Fprintf(b, "%.1f,%.1f", x, y)
+		}
+		fmt.Fprintf(b, `"><title>%s</title></polygon>`, html.EscapeString(gf.Name))
+	}
+
+	// PATHS
+
+	for _, trip := range splitTrips(records) {
+		clr := "#0000ff"
+		if devClrs != nil {
+			clr = devClrs[trip[0].DevKeyID]
+		}
+		fmt.Fprintf(b, `<polyline fill="none" stroke="%s" stroke-opacity="0.6" stroke-width="3" stroke-linejoin="round" points="`, clr)
+		for i, r := range trip {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			x, y := pr.xy(r)
+			fmt.Fprintf(b, "%.1f,%.1f", x, y)
+		}
+		b.WriteString(`"/>`)
+	}
+
+	// MARKERS
+
+	clrs := trackColors(records, devClrs)
+	for _, r := range records {
+		if !r.Track() {
+			continue
+		}
+		x, y := pr.xy(r)
+		if r.Label != 0 {
+			label := html.EscapeString(string(r.Label))
+			fmt.Fprintf(b, `<g id="m%s"><circle cx="%.1f" cy="%.1f" r="%d" fill="%s" stroke="#fff" stroke-width="1.5"/>`, label, x, y, svgMarkerR, clrs[r])
+			fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#fff" font-weight="bold">%s</text></g>`, x, y+4, label)
+		} else {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="%d" fill="%s" stroke="#fff"/>`, x, y, svgMarkerR/2, clrs[r])
+		}
+	}
+
+	// SCALE BAR: a "nice" length (1, 2 or 5 times a power of 10 meters) around a quarter of the width
+
+	target := float64(width) / 4 / pr.scale
+	length := math.Pow(10, math.Floor(math.Log10(target)))
+	for _, m := range []float64{5, 2} {
+		if length*m <= target {
+			length *= m
+			break
+		}
+	}
+	barW := length * pr.scale
+	bx, by := float64(svgPadding), float64(height-10)
+	fmt.Fprintf(b, `<path d="M%.1f %.1fv4h%.1fv-4" fill="none" stroke="#000" stroke-width="2"/>`, bx, by-4, barW)
+	label := fmt.Sprintf("%.0f m", length)
+	if length >= 1000 {
+		label = fmt.Sprintf("%.0f km", length/1000)
+	}
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f">%s</text>`, bx+barW+4, by, label)
+
+	// NORTH ARROW
+
+	nx, ny := float64(width-svgPadding/2-6), float64(svgPadding/2+4)
+	fmt.Fprintf(b, `<path d="M%.1f %.1fl6 16l-6 -4l-6 4z" fill="#000"/>`, nx, ny)
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle" font-weight="bold">N</text>`, nx, ny+28)
+
+	b.WriteString(`</svg>`)
+	_, err := b.WriteTo(w)
+	return err
+}
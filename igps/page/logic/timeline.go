@@ -0,0 +1,235 @@
+/*
+Timeline page logic: the day of a Device as alternating stays and trips.
+*/
+
+package logic
+
+import (
+	"appengine"
+	"fmt"
+	"html/template"
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+	"strings"
+	"time"
+)
+
+func init() {
+	page.NamePageMap["Timeline"].Logic = timeline
+}
+
+// Max number of GPS records of a day to build the timeline from.
+const maxTimelineRecords = 10000
+
+// Layout of the "date" form value of the Timeline page.
+const dateLayout = "2006-01-02"
+
+// timelineBlock is a block of a day timeline: either a stay or a trip between stays.
+type timelineBlock struct {
+	// Stay of the block, nil if the block is a trip
+	Stay *stay
+
+	// Track records of the block in chronological order.
+	// Records of a trip include the last record of the preceding stay and the first record of the following stay.
+	Records []*ds.GPS
+
+	// Distance covered in meters (trips only)
+	Dist int64
+
+	// Name of the location of a stay, or the start location of a trip
+	From string
+
+	// Name of the end location of a trip
+	To string
+}
+
+// Start returns the start time of the block.
+func (b *timelineBlock) Start() time.Time {
+	return b.Records[0].Created
+}
+
+// End returns the end time of the block.
+func (b *timelineBlock) End() time.Time {
+	return b.Records[len(b.Records)-1].Created
+}
+
+// Duration returns the duration of the block, truncated to seconds.
+func (b *timelineBlock) Duration() time.Duration {
+	return b.End().Sub(b.Start()) / time.Second * time.Second
+}
+
+// DistKm returns the distance covered in km.
+func (b *timelineBlock) DistKm() float64 {
+	return float64(b.Dist) / 1000
+}
+
+// timeline is the logic implementation of the Timeline page.
+//
+// Form parameters: "devID", the optional "date" of the day in "yyyy-mm-dd" format (today if not specified)
+// and the optional "stayRadius" and "stayMinDur" stay detection parameters (see parseStayParams()).
+func timeline(p *page.Params) {
+	c := p.AppCtx
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Devices"] = devices
+
+	fv := p.Request.FormValue
+
+	loc := p.Account.Location()
+	now := time.Now().In(loc)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if s := strings.TrimSpace(fv("date")); s != "" {
+		var err error
+		if day, err = p.ParseTime(dateLayout, s); err != nil {
+			p.ErrorMsg = template.HTML(`Invalid <span class="highlight">Date</span>!`)
+			return
+		}
+	}
+	// AddDate() is used instead of adding 24 hours because of daylight saving time
+	dayEnd := day.AddDate(0, 0, 1)
+	p.Custom["Date"] = day.Format(dateLayout)
+	p.Custom["PrevDate"] = day.AddDate(0, 0, -1).Format(dateLayout)
+	p.Custom["NextDate"] = dayEnd.Format(dateLayout)
+	p.Custom["Today"] = now.Format(dateLayout)
+
+	p.Custom["StayRadius"] = defStayRadius
+	if fv("stayRadius") != "" {
+		p.Custom["StayRadius"] = fv("stayRadius")
+	}
+	p.Custom["StayMinDur"] = defStayMinDur
+	if fv("stayMinDur") != "" {
+		p.Custom["StayMinDur"] = fv("stayMinDur")
+	}
+	p.Custom["MaxRecords"] = maxTimelineRecords
+
+	if fv("devID") == "" {
+		// No device chosen yet
+		return
+	}
+
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		return
+	}
+	p.Custom["Device"] = dev
+
+	radius, minDur, ok := parseStayParams(p)
+	if !ok {
+		return
+	}
+
+	// The after filter is exclusive, step back a microsecond (datastore time precision) to include midnight
+	records, truncated, err := loadRecords(c, dev.KeyID, dayEnd, day.Add(-time.Microsecond), -1, maxTimelineRecords)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	p.Custom["Truncated"] = truncated
+	calcMetrics(records)
+
+	var places []*ds.Place
+	if places, p.Err = cache.GetPlaceListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+
+	stays := detectStays(records, radius, minDur)
+	labelStays(stays, places)
+
+	blocks := timelineBlocks(c, records, stays, places)
+	p.Custom["Blocks"] = blocks
+	p.Custom["NoBlocks"] = len(blocks) == 0
+
+	var tripDist int64
+	var stayDur, tripDur time.Duration
+	for _, b := range blocks {
+		if b.Stay != nil {
+			stayDur += b.Duration()
+		} else {
+			tripDist += b.Dist
+			tripDur += b.Duration()
+		}
+	}
+	p.Custom["TripDistKm"] = float64(tripDist) / 1000
+	p.Custom["StayDur"] = stayDur
+	p.Custom["TripDur"] = tripDur
+}
+
+// timelineBlocks builds the timeline blocks from the specified records of a device (must be in chronological order,
+// with metrics calculated, see calcMetrics()) and the stays detected in them: stays and the trips between them,
+// alternating. Track records before the first and after the last stay also form a trip.
+func timelineBlocks(c appengine.Context, records []*ds.GPS, stays []*stay, places []*ds.Place) (blocks []*timelineBlock) {
+	var track []*ds.GPS
+	idxs := make(map[*ds.GPS]int) // Indices in track mapped from the Track records
+	for _, r := range records {
+		if r.Track() {
+			idxs[r] = len(track)
+			track = append(track, r)
+		}
+	}
+	if len(track) == 0 {
+		return nil
+	}
+
+	// addTrip adds the trip of track records from..to (inclusive) if it has at least 2 records.
+	addTrip := func(from, to int) {
+		if to <= from {
+			return
+		}
+		b := &timelineBlock{Records: track[from : to+1]}
+		for _, r := range b.Records[1:] {
+			if r.Dd > 0 {
+				b.Dist += r.Dd
+			}
+		}
+		b.From = locName(c, places, track[from].GeoPoint)
+		b.To = locName(c, places, track[to].GeoPoint)
+		blocks = append(blocks, b)
+	}
+
+	from := 0 // Start index of the next trip
+	for _, s := range stays {
+		addTrip(from, idxs[s.Records[0]])
+		if n := len(blocks); n > 0 && blocks[n-1].Stay == nil {
+			// A trip ends at the stay, name its end the same
+			blocks[n-1].To = stayName(c, s)
+		}
+
+		b := &timelineBlock{Stay: s, Records: s.Records, From: stayName(c, s)}
+		blocks = append(blocks, b)
+		from = idxs[s.Records[len(s.Records)-1]]
+	}
+	addTrip(from, len(track)-1)
+
+	// Trips between stays start at the preceding stay
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].Stay == nil && blocks[i-1].Stay != nil {
+			blocks[i].From = blocks[i-1].From
+		}
+	}
+
+	return
+}
+
+// stayName returns the name of the location of the specified stay (see locName()).
+func stayName(c appengine.Context, s *stay) string {
+	if s.Place != nil {
+		return s.Place.Name
+	}
+	return locName(c, nil, s.GeoPoint)
+}
+
+// locName returns a human readable name of the specified location: the name of the Place it falls in,
+// the nearest locality (see reverseGeocode()), or the coordinates if neither is available.
+func locName(c appengine.Context, places []*ds.Place, gp appengine.GeoPoint) string {
+	if place := placeAt(places, gp); place != nil {
+		return place.Name
+	}
+	if g := reverseGeocode(c, gp.Lat, gp.Lng); g != nil {
+		return "near " + g.String()
+	}
+	return fmt.Sprintf("%.5f,%.5f", gp.Lat, gp.Lng)
+}
@@ -0,0 +1,87 @@
+/*
+Places Visited page logic: lists the stays of a Device.
+*/
+
+package logic
+
+import (
+	"igps/cache"
+	"igps/ds"
+	"igps/page"
+)
+
+func init() {
+	page.NamePageMap["Visited"].Logic = visited
+}
+
+// Max number of GPS records to detect stays in.
+const maxVisitedRecords = 10000
+
+// visited is the logic implementation of the Places Visited page.
+//
+// Form parameters: "devID", the optional "before" and "after" time filters (same as on the Logs page)
+// and the optional "stayRadius" and "stayMinDur" stay detection parameters (see parseStayParams()).
+func visited(p *page.Params) {
+	c := p.AppCtx
+
+	var devices []*ds.Device
+	if devices, p.Err = cache.GetDevListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+	p.Custom["Devices"] = devices
+
+	fv := p.Request.FormValue
+
+	p.Custom["Before"] = fv("before")
+	p.Custom["After"] = fv("after")
+	p.Custom["StayRadius"] = defStayRadius
+	if fv("stayRadius") != "" {
+		p.Custom["StayRadius"] = fv("stayRadius")
+	}
+	p.Custom["StayMinDur"] = defStayMinDur
+	if fv("stayMinDur") != "" {
+		p.Custom["StayMinDur"] = fv("stayMinDur")
+	}
+	p.Custom["MaxRecords"] = maxVisitedRecords
+
+	if fv("devID") == "" {
+		// No device chosen yet
+		return
+	}
+
+	dev := checkDevice(p, fv("devID"), devices)
+	if dev == nil {
+		return
+	}
+	p.Custom["Device"] = dev
+
+	before, after, ok := parseTimeFilters(p)
+	if !ok {
+		return
+	}
+	radius, minDur, ok := parseStayParams(p)
+	if !ok {
+		return
+	}
+
+	records, truncated, err := loadRecords(c, dev.KeyID, before, after, -1, maxVisitedRecords)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	p.Custom["Truncated"] = truncated
+
+	var places []*ds.Place
+	if places, p.Err = cache.GetPlaceListForAccKey(c, p.Account.GetKey(c)); p.Err != nil {
+		return
+	}
+
+	stays := detectStays(records, radius, minDur)
+	labelStays(stays, places)
+	// Latest first
+	for i, j := 0, len(stays)-1; i < j; i, j = i+1, j-1 {
+		stays[i], stays[j] = stays[j], stays[i]
+	}
+	p.Custom["Stays"] = stays
+	p.Custom["NoStays"] = len(stays) == 0
+}
@@ -46,7 +46,8 @@ type Page struct {
 	// Page logic function
 	Logic func(params *Params)
 
-	// Name of the page template
+	// Name of the page template.
+	// Empty for raw pages whose logic writes the response itself (e.g. file exports).
 	TemplName string
 
 	// Tells if the page should be visible in the menu
@@ -56,6 +57,11 @@ type Page struct {
 	Error bool
 }
 
+// Raw tells if the page has no template and its logic writes the response itself.
+func (p *Page) Raw() bool {
+	return p.TemplName == ""
+}
+
 // Link returns an HTML link (<a>) pointing to the page.
 func (p *Page) Link() template.HTML {
 	return template.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, p.Path, html.EscapeString(p.Title)))
@@ -66,15 +72,30 @@ var Pages = []*Page{
 	// "Normal" pages
 	&Page{"Home", "/", "Home", NO_LOGIN, nil, "home.html", VISIBLE, NOT_ERROR},
 	&Page{"Devices", "/devices", "Devices", REQ_LOGIN, nil, "devices.html", VISIBLE, NOT_ERROR},
+	&Page{"Places", "/places", "Places", REQ_LOGIN, nil, "places.html", VISIBLE, NOT_ERROR},
+	&Page{"Geofences", "/geofences", "Geofences", REQ_LOGIN, nil, "geofences.html", VISIBLE, NOT_ERROR},
 	&Page{"Logs", "/logs", "Logs", REQ_LOGIN, nil, "logs.html", VISIBLE, NOT_ERROR},
+	&Page{"Visited", "/visited", "Places Visited", REQ_LOGIN, nil, "visited.html", VISIBLE, NOT_ERROR},
+	&Page{"Timeline", "/timeline", "Timeline", REQ_LOGIN, nil, "timeline.html", VISIBLE, NOT_ERROR},
+	&Page{"Charts", "/charts", "Charts", REQ_LOGIN, nil, "charts.html", VISIBLE, NOT_ERROR},
+	&Page{"Coverage", "/coverage", "Coverage", REQ_LOGIN, nil, "coverage.html", VISIBLE, NOT_ERROR},
 	&Page{"Alerts", "/alerts", "Alerts", REQ_LOGIN, nil, "alerts.html", VISIBLE, NOT_ERROR},
+	&Page{"AlertHistory", "/alerthistory", "Alert History", REQ_LOGIN, nil, "alert_history.html", VISIBLE, NOT_ERROR},
 	&Page{"Settings", "/settings", "Settings", REQ_LOGIN, nil, "settings.html", VISIBLE, NOT_ERROR},
 	&Page{"TermsAndPolicy", "/termsandpolicy", "Terms and Policy", NO_LOGIN, nil, "terms_and_policy.html", VISIBLE, NOT_ERROR},
 	&Page{"Register", "/register", "Register", NO_LOGIN, nil, "register.html", NOT_VISIBLE, NOT_ERROR},
+	&Page{"AlertAck", "/alertack", "Alert", NO_LOGIN, nil, "alert_ack.html", NOT_VISIBLE, NOT_ERROR}, // Signed link required
+
+	// Raw pages (no templates, logic writes the response)
+	&Page{"Export", "/export", "Export", REQ_LOGIN, nil, "", NOT_VISIBLE, NOT_ERROR},
+	&Page{"LogsJSON", "/logsjson", "Logs JSON", REQ_LOGIN, nil, "", NOT_VISIBLE, NOT_ERROR},
+	&Page{"GeoJSON", "/geojson", "GeoJSON", NO_LOGIN, nil, "", NOT_VISIBLE, NOT_ERROR}, // Login or API token required
+	&Page{"EmbedMap", "/embedmap", "Map", NO_LOGIN, nil, "", NOT_VISIBLE, NOT_ERROR},   // Path is maps.EmbedPagePath
 
 	// Error pages
 	&Page{"NotFound", "/notfound", "Page Not Found :-(", NO_LOGIN, nil, "err_not_found.html", NOT_VISIBLE, IS_ERROR},
 	&Page{"NotLoggedIn", "/notloggedin", "Not Logged In", NO_LOGIN, nil, "err_not_logged_in.html", NOT_VISIBLE, IS_ERROR},
+	&Page{"BadRequest", "/badrequest", "Bad Request", NO_LOGIN, nil, "err_bad_request.html", NOT_VISIBLE, IS_ERROR},
 	&Page{"NoAccount", "/noaccount", "No IczaGPS Account", NO_LOGIN, nil, "err_no_account.html", NOT_VISIBLE, IS_ERROR},
 	&Page{"InternalError", "/internalerror", "Internal Error %#$@~", NO_LOGIN, nil, "err_internal.html", NOT_VISIBLE, IS_ERROR},
 }
@@ -115,7 +136,7 @@ func pageHandler(w http.ResponseWriter, r *http.Request) {
 			page = NamePageMap["NotFound"]
 			w.WriteHeader(http.StatusNotFound)
 		}
-		p = NewParams(r, page)
+		p = NewParams(w, r, page)
 	}
 
 	c := p.AppCtx
@@ -145,11 +166,24 @@ func pageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Raw page logic writes the response, track if it has started to
+	var rw *rawWriter
+	if p.Page.Raw() {
+		rw = &rawWriter{ResponseWriter: w}
+		p.ResponseWriter = rw
+	}
+
 	if p.Err == nil && p.Page.Logic != nil {
 		// Run page logic protected so we can serve our nice InternalError page in case the logic panics:
 		runLogic(p)
 	}
 
+	if rw != nil && rw.written && (p.Err != nil || p.ErrorMsg != nil) {
+		// Response is partially written, an error page can't be rendered anymore
+		c.Errorf("Raw page logic failed after writing the response: %v %v", p.Err, p.ErrorMsg)
+		return
+	}
+
 	if p.Err != nil {
 		c.Errorf("%s", p.Err)
 		p.Page = NamePageMap["InternalError"]
@@ -158,6 +192,19 @@ func pageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.Page.Raw() {
+		if p.ErrorMsg == nil {
+			// Page logic wrote the response.
+			return
+		}
+		// Page logic rejected the request, render the error message in the BadRequest page:
+		c.Debugf("Params.ErrorMsg: %v", p.ErrorMsg)
+		p.Page = NamePageMap["BadRequest"]
+		w.WriteHeader(http.StatusBadRequest)
+		Htmls.ExecuteTemplate(w, p.Page.TemplName, p)
+		return
+	}
+
 	// Log page logic response messages
 	if p.InfoMsg != nil {
 		c.Debugf("Params.InfoMsg: %v", p.InfoMsg)
@@ -184,3 +231,23 @@ func runLogic(p *Params) {
 
 	p.Page.Logic(p)
 }
+
+// rawWriter is a http.ResponseWriter which tracks if the response has started to be written.
+type rawWriter struct {
+	http.ResponseWriter
+
+	// Tells if the header or the body has been written
+	written bool
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader().
+func (rw *rawWriter) WriteHeader(code int) {
+	rw.written = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.Write().
+func (rw *rawWriter) Write(b []byte) (int, error) {
+	rw.written = true
+	return rw.ResponseWriter.Write(b)
+}
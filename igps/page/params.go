@@ -29,6 +29,9 @@ type Params struct {
 	// The http request
 	Request *http.Request
 
+	// The http response writer. Only raw pages (which have no templates) should write to it directly.
+	ResponseWriter http.ResponseWriter
+
 	// Tells if Mobile client is detected and Mobile variant should be rendered
 	Mobile bool
 
@@ -70,12 +73,12 @@ type Params struct {
 }
 
 // NewParams returns a new initialized Params
-func NewParams(r *http.Request, page *Page) *Params {
+func NewParams(w http.ResponseWriter, r *http.Request, page *Page) *Params {
 	now := time.Now()
 	c := appengine.NewContext(r)
 
 	p := Params{Pages: Pages, PathPageMap: PathPageMap, NamePageMap: NamePageMap,
-		Request: r, Mobile: isMobile(r), Page: page, Start: now, AppCtx: c,
+		Request: r, ResponseWriter: w, Mobile: isMobile(r), Page: page, Start: now, AppCtx: c,
 		Custom: make(map[string]interface{})}
 
 	p.User = user.Current(c)
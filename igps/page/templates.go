@@ -7,6 +7,7 @@ package page
 
 import (
 	"html/template"
+	"igps/maps"
 	"time"
 )
 
@@ -15,6 +16,8 @@ var Htmls *template.Template = template.Must(template.New("base").Funcs(map[stri
 	"Odd": Odd,
 	"Add": Add,
 	"Now": time.Now,
+
+	"ViewMapURL": ViewMapURL,
 }).ParseGlob("igps/page/html/*.html"))
 
 // Odd tells if the specified number is odd (cannot be divided by 2).
@@ -26,3 +29,9 @@ func Odd(i int) bool {
 func Add(i, j int) int {
 	return i + j
 }
+
+// ViewMapURL returns the URL of a map page showing the specified location with the specified zoom level,
+// built by the configured map provider.
+func ViewMapURL(lat, lng float64, zoom int) string {
+	return maps.Current().ViewURL(maps.Center(lat, lng), zoom)
+}
@@ -49,3 +49,12 @@ function htmlToText(html) {
 	temp.innerHTML = html;
 	return temp.innerText;
 }
+
+/**
+ * Escapes the specified text to be safely inserted into HTML.
+ */
+function htmlEscape(text) {
+	var temp = document.createElement("div");
+	temp.appendChild(document.createTextNode(text));
+	return temp.innerHTML;
+}
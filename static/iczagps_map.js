@@ -0,0 +1,314 @@
+/**
+ * Interactive map with track playback, used on the Logs page.
+ *
+ * Records are fetched in JSON format from the Logs JSON page, and displayed
+ * using the Google Maps JavaScript API which is loaded on first use.
+ */
+
+var imap = {
+	// Container element of the map and the playback controls
+	container : null,
+	// Map type id, e.g. "roadmap"
+	mapType : null,
+	// Google Maps objects
+	map : null,
+	infoWindow : null,
+	// Progress lines and position markers of the devices, mapped from device keys
+	progressLines : {},
+	posMarkers : {},
+	// Track records in chronological order (events have no location)
+	points : [],
+	// Playback timer and speed (record/sec)
+	timer : null,
+	speed : 4
+};
+
+/**
+ * Shows the interactive map in the specified container element, displaying
+ * the records returned by the specified JSON URL with the specified map type.
+ */
+function showInteractiveMap(container, jsonURL, apiKey, mapType, width, height) {
+	imapStop();
+	imap.container = container;
+	imap.mapType = mapType;
+	container.innerHTML = "<div id='imapCanvas' style='width:" + width + "px;height:" + height + "px'></div>"
+			+ "<div id='imapControls'>"
+			+ "<input type='button' id='imapPlayId' value='&#9654;' title='Play / Pause' onclick='imapPlayPause();' /> "
+			+ "<input type='range' id='imapSliderId' min='0' max='0' value='0' oninput='imapSeek(+this.value);' onchange='imapSeek(+this.value);' /> "
+			+ "<select id='imapSpeedId' title='Playback speed' onchange='imap.speed = +this.value;'>"
+			+ "<option value='1'>1x</option><option value='4' selected>4x</option><option value='16'>16x</option><option value='64'>64x</option>"
+			+ "</select> <span id='imapTimeId' class='note'>Loading...</span></div>";
+
+	imapLoadAPI(apiKey, function() {
+		var xhr = new XMLHttpRequest();
+		xhr.onreadystatechange = function() {
+			if (xhr.readyState != 4)
+				return;
+			var resp;
+			try {
+				resp = JSON.parse(xhr.responseText);
+			} catch (e) {
+				resp = {
+					error : "Failed to load records!"
+				};
+			}
+			if (xhr.status != 200 || resp.error) {
+				document.getElementById("imapTimeId").innerHTML = "<span class='error'>" + (resp.error || "Failed to load records!") + "</span>";
+				return;
+			}
+			imapInit(resp);
+		};
+		xhr.open("GET", jsonURL, true);
+		xhr.send();
+	});
+}
+
+/**
+ * Loads the Google Maps JavaScript API (if not yet loaded), and calls the
+ * specified function when it is ready.
+ */
+function imapLoadAPI(apiKey, ready) {
+	if (window.google && google.maps) {
+		ready();
+		return;
+	}
+	window.imapAPIReady = ready;
+	var s = document.createElement("script");
+	s.src = "https://maps.googleapis.com/maps/api/js?key=" + encodeURIComponent(apiKey) + "&callback=imapAPIReady";
+	document.body.appendChild(s);
+}
+
+/**
+ * Initializes the map with the specified response of the Logs JSON page.
+ */
+function imapInit(resp) {
+	// Records are in reverse chronological order, we need them chronological.
+	var records = resp.records.slice().reverse();
+
+	imap.map = new google.maps.Map(document.getElementById("imapCanvas"), {
+		mapTypeId : imap.mapType || google.maps.MapTypeId.ROADMAP
+	});
+	imap.infoWindow = new google.maps.InfoWindow();
+	imap.points = [];
+
+	// Geofences are drawn beneath the tracks (the map is fitted to the tracks only)
+	var geofences = resp.geofences || [];
+	for (var i = 0; i < geofences.length; i++)
+		imapAddGeofence(geofences[i]);
+
+	// Records of several devices are distinguished by device names and colors
+	// (colors are unique, they are used as device keys). Trips are collected per device.
+	var bounds = new google.maps.LatLngBounds();
+	var trips = {};
+	function endTrip(dev) {
+		var trip = trips[dev.key];
+		if (trip && trip.length > 1)
+			new google.maps.Polyline({
+				map : imap.map,
+				path : trip,
+				strokeColor : dev.clr,
+				strokeOpacity : 0.3,
+				strokeWeight : 3
+			});
+		trips[dev.key] = [];
+	}
+
+	var devs = {};
+	for (var i = 0; i < records.length; i++) {
+		var r = records[i];
+		var dev = devs[r.dclr || ""];
+		if (!dev)
+			dev = devs[r.dclr || ""] = {
+				key : r.dclr || "",
+				clr : r.dclr || "blue"
+			};
+		r.devKey = dev.key;
+		if (!r.clr) {
+			// Event: Start and Stop events end trips
+			if (r.evt == "Start" || r.evt == "Stop")
+				endTrip(dev);
+			continue;
+		}
+		var pos = new google.maps.LatLng(r.lat, r.lng);
+		r.pos = pos;
+		(trips[dev.key] = trips[dev.key] || []).push(pos);
+		bounds.extend(pos);
+		imap.points.push(r);
+		imapAddMarker(r);
+	}
+	for ( var key in devs)
+		endTrip(devs[key]);
+
+	var timeTag = document.getElementById("imapTimeId");
+	if (imap.points.length == 0) {
+		timeTag.innerHTML = "There are no locations to display.";
+		return;
+	}
+	imap.map.fitBounds(bounds);
+
+	imap.progressLines = {};
+	imap.posMarkers = {};
+	for ( var key in devs) {
+		imap.progressLines[key] = new google.maps.Polyline({
+			map : imap.map,
+			strokeColor : devs[key].clr,
+			strokeOpacity : 0.9,
+			strokeWeight : 4
+		});
+		imap.posMarkers[key] = new google.maps.Marker({
+			map : imap.map,
+			zIndex : google.maps.Marker.MAX_ZINDEX + 1,
+			visible : false
+		});
+	}
+
+	var slider = document.getElementById("imapSliderId");
+	slider.max = imap.points.length - 1;
+	imapSeek(0);
+	if (resp.truncated)
+		timeTag.title = "Only the latest " + records.length + " records are displayed.";
+}
+
+/**
+ * Adds a clickable marker for the specified Track record, colored the same way
+ * as on static map images.
+ */
+function imapAddMarker(r) {
+	var m = new google.maps.Marker({
+		map : imap.map,
+		position : r.pos,
+		title : (r.dev ? r.dev + " " : "") + "#" + r.no + " " + r.time,
+		icon : {
+			path : google.maps.SymbolPath.CIRCLE,
+			scale : 5,
+			fillColor : r.clr,
+			fillOpacity : 1,
+			strokeColor : "white",
+			strokeWeight : 1
+		}
+	});
+	google.maps.event.addListener(m, "click", function() {
+		imap.infoWindow.setContent(imapRecordHTML(r));
+		imap.infoWindow.open(imap.map, m);
+	});
+}
+
+/**
+ * Draws the specified geofence (its closed outline), its name is displayed on click.
+ */
+function imapAddGeofence(gf) {
+	var path = [];
+	for (var i = 0; i < gf.pts.length; i++)
+		path.push(new google.maps.LatLng(gf.pts[i][0], gf.pts[i][1]));
+	var p = new google.maps.Polygon({
+		map : imap.map,
+		paths : path,
+		strokeColor : "#9400d3",
+		strokeOpacity : 0.8,
+		strokeWeight : 2,
+		fillColor : "#9400d3",
+		fillOpacity : 0.1
+	});
+	google.maps.event.addListener(p, "click", function(e) {
+		imap.infoWindow.setContent("<b>" + htmlEscape(gf.nm) + "</b>");
+		imap.infoWindow.setPosition(e.latLng);
+		imap.infoWindow.open(imap.map);
+	});
+}
+
+/**
+ * Returns the HTML details of the specified record, same data as in the Logs table row.
+ */
+function imapRecordHTML(r) {
+	var s = "<table class='imapInfo'>";
+	s += "<tr><th>#</th><td>" + r.no + "</td></tr>";
+	if (r.dev)
+		s += "<tr><th>Device</th><td>" + htmlEscape(r.dev) + "</td></tr>";
+	s += "<tr><th>Ago</th><td>" + r.ago + "</td></tr>";
+	s += "<tr><th>Time</th><td>" + r.time + "</td></tr>";
+	s += "<tr><th>Location</th><td>" + r.lat + "," + r.lng + "</td></tr>";
+	if (r.place)
+		s += "<tr><th>Place</th><td>" + htmlEscape(r.place) + "</td></tr>";
+	if (r.near)
+		s += "<tr><th>Near</th><td>" + htmlEscape(r.near) + "</td></tr>";
+	if (r.dd !== undefined) {
+		s += "<tr><th>&#916;d</th><td>" + r.dd + " m</td></tr>";
+		s += "<tr><th>&#916;t</th><td>" + r.dt + " s</td></tr>";
+		s += "<tr><th>v</th><td>" + r.v + " km/h</td></tr>";
+	}
+	return s + "</table>";
+}
+
+/**
+ * Moves the playback position to the specified Track record index.
+ */
+function imapSeek(idx) {
+	if (imap.points.length == 0)
+		return;
+	var r = imap.points[idx];
+	// Progress and position of each device up to the record:
+	var paths = {}, lasts = {};
+	for ( var key in imap.progressLines)
+		paths[key] = [];
+	for (var i = 0; i <= idx; i++) {
+		var p = imap.points[i];
+		paths[p.devKey].push(p.pos);
+		lasts[p.devKey] = p;
+	}
+	for ( var key in imap.progressLines) {
+		imap.progressLines[key].setPath(paths[key]);
+		var m = imap.posMarkers[key], last = lasts[key];
+		m.setVisible(!!last);
+		if (last) {
+			m.setPosition(last.pos);
+			m.setTitle((last.dev ? last.dev + " " : "") + "#" + last.no + " " + last.time);
+		}
+	}
+	document.getElementById("imapSliderId").value = idx;
+	document.getElementById("imapTimeId").innerHTML = r.time + " (" + (idx + 1) + "/" + imap.points.length + ")";
+}
+
+/**
+ * Starts or pauses the playback.
+ */
+function imapPlayPause() {
+	if (imap.timer) {
+		imapStop();
+		return;
+	}
+	var slider = document.getElementById("imapSliderId");
+	if (+slider.value >= imap.points.length - 1)
+		imapSeek(0); // Restart from the beginning
+	document.getElementById("imapPlayId").value = "\u275A\u275A";
+	imapStep();
+}
+
+/**
+ * Steps the playback to the next record, and schedules the next step.
+ */
+function imapStep() {
+	imap.timer = null;
+	var slider = document.getElementById("imapSliderId");
+	if (!slider)
+		return; // Map has been replaced (e.g. by a static map image)
+	var idx = +slider.value + 1;
+	if (idx >= imap.points.length) {
+		imapStop();
+		return;
+	}
+	imapSeek(idx);
+	imap.timer = setTimeout(imapStep, 1000 / imap.speed);
+}
+
+/**
+ * Stops the playback.
+ */
+function imapStop() {
+	if (imap.timer) {
+		clearTimeout(imap.timer);
+		imap.timer = null;
+	}
+	var b = document.getElementById("imapPlayId");
+	if (b)
+		b.value = "\u25B6";
+}